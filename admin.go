@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminMux serves the admin API, features register their endpoints on it
+var adminMux = http.NewServeMux()
+
+// serveAdmin serves the admin API on address and port, to clients presenting token when it is set
+func serveAdmin(address string, port int, token string) {
+	server := http.Server{
+		Addr:    net.JoinHostPort(address, strconv.Itoa(port)),
+		Handler: adminAuth(token, adminMux),
+	}
+	log.Printf("Admin API started at %s\n", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// adminAuth lets requests through that carry token as a bearer token or as the password of
+// basic authentication, which browsers ask for on the playground, or all requests without a token
+func adminAuth(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, presented, _ = r.BasicAuth()
+		}
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lbsim admin"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong admin token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback reports whether address only accepts local connections
+func isLoopback(address string) bool {
+	if address == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsLoopback()
+}
+
+// writeJSON responds with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	handler := adminAuth("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for name, authorize := range map[string]func(*http.Request){
+		"none":   func(r *http.Request) {},
+		"bearer": func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") },
+		"basic":  func(r *http.Request) { r.SetBasicAuth("admin", "s3cret") },
+		"wrong":  func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cre") },
+	} {
+		r := httptest.NewRequest("GET", "/servers", nil)
+		authorize(r)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		expected := http.StatusUnauthorized
+		if name == "bearer" || name == "basic" {
+			expected = http.StatusOK
+		}
+		if w.Code != expected {
+			t.Errorf("%s: expected %d, got %d", name, expected, w.Code)
+		}
+	}
+}
+
+func TestAdminLoopback(t *testing.T) {
+	for address, loopback := range map[string]bool{"127.0.0.1": true, "::1": true, "localhost": true, "0.0.0.0": false, "": false, "10.0.0.1": false} {
+		if isLoopback(address) != loopback {
+			t.Errorf("%q: expected loopback %v", address, loopback)
+		}
+	}
+}
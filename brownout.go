@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// brownoutHeader passes the brownout level to backends, it is removed from client requests
+var brownoutHeader = "X-Brownout-Level"
+
+// Brownout asks backends to shed optional work while their pool approaches saturation.
+// The level of a pool is the number of utilization thresholds it has crossed, it only
+// drops again once utilization is below a threshold by more than the hysteresis.
+type Brownout struct {
+	Thresholds []float64
+	Hysteresis float64
+}
+
+// NewBrownout parses the comma separated utilization thresholds, e.g. 0.7,0.85,0.95
+func NewBrownout(thresholds string, hysteresis float64) (*Brownout, error) {
+	b := &Brownout{Hysteresis: hysteresis}
+	for _, tok := range strings.Split(thresholds, ",") {
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(tok), 64)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("invalid brownout threshold %q", tok)
+		}
+		b.Thresholds = append(b.Thresholds, threshold)
+	}
+	sort.Float64s(b.Thresholds)
+	if hysteresis < 0 {
+		return nil, fmt.Errorf("brownout hysteresis must not be negative")
+	}
+	return b, nil
+}
+
+// Level updates and returns the brownout level of the pool
+func (b *Brownout) Level(pool *ServerPool) int {
+	utilization := pool.Utilization()
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	level := pool.brownout
+	for level < len(b.Thresholds) && utilization >= b.Thresholds[level] {
+		level++
+	}
+	if level == pool.brownout {
+		for level > 0 && utilization < b.Thresholds[level-1]-b.Hysteresis {
+			level--
+		}
+	}
+	if level != pool.brownout {
+		log.Printf("Pool %s brownout level %d -> %d (utilization %.2f)\n", pool.Name, pool.brownout, level, utilization)
+		pool.brownout = level
+	}
+	return level
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBrownoutLevel(t *testing.T) {
+	b, err := NewBrownout("0.9,0.5", 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := selectionPool("a", "b")
+	pool.MaxConnections = 10
+	set := func(connections int) {
+		for _, server := range pool.servers {
+			for server.Connections() < connections {
+				server.addConnection(1)
+			}
+			for server.Connections() > connections {
+				server.removeConnection(1)
+			}
+		}
+	}
+	// thresholds are sorted, levels rise as soon as a threshold is reached and
+	// only drop once utilization is below it by more than the hysteresis
+	for _, step := range []struct{ connections, level int }{{4, 0}, {5, 1}, {9, 2}, {8, 2}, {5, 1}, {4, 1}, {3, 0}, {10, 2}, {0, 0}} {
+		set(step.connections)
+		if level := b.Level(pool); level != step.level {
+			t.Fatalf("at %d connections per server expected level %d, got %d", step.connections, step.level, level)
+		}
+	}
+
+	for _, invalid := range []string{"", "0.5,x", "-0.5"} {
+		if _, err := NewBrownout(invalid, 0.1); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+	if _, err := NewBrownout("0.5", -0.1); err == nil {
+		t.Error("expected a negative hysteresis to be rejected")
+	}
+}
+
+func TestBrownoutHeaderFromClients(t *testing.T) {
+	defer func(b *Brownout) { brownout = b }(brownout)
+	var received []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get(brownoutHeader))
+	}))
+	defer backend.Close()
+	applyConfig(&Config{
+		Pools:  map[string]*PoolConfig{"app": {Servers: []*ServerConfig{{URL: backend.URL}}}},
+		Routes: []*RouteConfig{{Prefix: "/", Pool: "app"}},
+	})
+	defer routes.Store(nil)
+
+	for _, b := range []*Brownout{nil, {Thresholds: []float64{0.5}}} {
+		brownout = b
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(brownoutHeader, "3")
+		lb(httptest.NewRecorder(), r)
+	}
+	if len(received) != 2 || received[0] != "" || received[1] != "0" {
+		t.Fatalf("expected the client's level to be replaced, got %q", received)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var errBufferFull = errors.New("buffer limit exceeded")
+
+// spool keeps up to memory bytes in memory and the rest in a temporary file
+type spool struct {
+	mem    bytes.Buffer
+	file   *os.File
+	size   int64
+	memory int64
+	limit  int64
+	dir    string
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.size+int64(len(p)) > s.limit {
+		return 0, errBufferFull
+	}
+	s.size += int64(len(p))
+	if s.file == nil && int64(s.mem.Len()+len(p)) <= s.memory {
+		return s.mem.Write(p)
+	}
+	if s.file == nil {
+		file, err := os.CreateTemp(s.dir, "lbsim-buffer-")
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+	}
+	return s.file.Write(p)
+}
+
+// Reader returns the buffered bytes from the start
+func (s *spool) Reader() io.Reader {
+	if s.file == nil {
+		return bytes.NewReader(s.mem.Bytes())
+	}
+	return io.MultiReader(bytes.NewReader(s.mem.Bytes()), io.NewSectionReader(s.file, 0, s.size-int64(s.mem.Len())))
+}
+
+// Close removes the temporary file
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// Buffering shields backends from slow clients by reading request bodies completely
+// before they are proxied and reading responses completely before they are sent on
+type Buffering struct {
+	Requests  bool
+	Responses bool
+	Memory    int64
+	Limit     int64
+	Dir       string
+}
+
+func (b *Buffering) spool() *spool {
+	return &spool{memory: b.Memory, limit: b.Limit, dir: b.Dir}
+}
+
+// Middleware reads request bodies into the buffer before passing requests on to next,
+// rejecting bodies over the limit with 413
+func (b *Buffering) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.Requests || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > b.Limit {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		buf := b.spool()
+		defer buf.Close()
+		if _, err := io.Copy(buf, r.Body); err != nil {
+			if err == errBufferFull {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			log.Printf("%s(%s) Failed to buffer request body, error: %s\n", r.RemoteAddr, r.URL.Path, err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(buf.Reader())
+		r.ContentLength = buf.size
+		r.TransferEncoding = nil
+		r.Header.Set("Content-Length", strconv.FormatInt(buf.size, 10))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wrap returns a writer holding the response back until Finish is called. Responses
+// over the limit and event streams are passed through as they arrive.
+func (b *Buffering) Wrap(w http.ResponseWriter) *bufferedResponse {
+	return &bufferedResponse{ResponseWriter: w, buf: b.spool()}
+}
+
+// bufferedResponse buffers a response so the backend connection is released before
+// the response is sent to the client
+type bufferedResponse struct {
+	http.ResponseWriter
+	status    int
+	buf       *spool
+	streaming bool
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	if br.streaming || status < 200 {
+		br.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if br.status != 0 {
+		return
+	}
+	br.status = status
+	if strings.HasPrefix(br.Header().Get("Content-Type"), "text/event-stream") {
+		br.stream()
+	}
+}
+
+func (br *bufferedResponse) Write(p []byte) (int, error) {
+	if br.status == 0 {
+		br.WriteHeader(http.StatusOK)
+	}
+	if br.streaming {
+		return br.ResponseWriter.Write(p)
+	}
+	n, err := br.buf.Write(p)
+	if err == errBufferFull {
+		if err := br.stream(); err != nil {
+			return 0, err
+		}
+		return br.ResponseWriter.Write(p)
+	}
+	return n, err
+}
+
+// stream sends what has been buffered so far and passes everything else through
+func (br *bufferedResponse) stream() error {
+	br.streaming = true
+	br.ResponseWriter.WriteHeader(br.status)
+	_, err := io.Copy(br.ResponseWriter, br.buf.Reader())
+	br.buf.Close()
+	return err
+}
+
+func (br *bufferedResponse) Flush() {
+	if !br.streaming {
+		return
+	}
+	if f, ok := br.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (br *bufferedResponse) Unwrap() http.ResponseWriter {
+	return br.ResponseWriter
+}
+
+// Finish sends the buffered response to the client
+func (br *bufferedResponse) Finish() {
+	if br.streaming || br.status == 0 {
+		br.buf.Close()
+		return
+	}
+	br.streaming = true
+	br.ResponseWriter.WriteHeader(br.status)
+	io.Copy(br.ResponseWriter, br.buf.Reader())
+	br.buf.Close()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	s := &spool{memory: 4, limit: 10, dir: t.TempDir()}
+	for _, part := range []string{"abc", "defg", "hij"} {
+		if _, err := s.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.file == nil || s.mem.Len() != 3 {
+		t.Fatalf("expected the bytes over the memory budget in a file, got %d in memory", s.mem.Len())
+	}
+	if data, _ := io.ReadAll(s.Reader()); string(data) != "abcdefghij" {
+		t.Fatalf("expected the buffered bytes in order, got %q", data)
+	}
+	if _, err := s.Write([]byte("k")); err != errBufferFull {
+		t.Fatalf("expected the limit to be enforced, got %v", err)
+	}
+	name := s.file.Name()
+	s.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("expected the temporary file to be removed, got %v", err)
+	}
+}
+
+func TestBufferingRequests(t *testing.T) {
+	b := &Buffering{Requests: true, Memory: 4, Limit: 8, Dir: t.TempDir()}
+	var received string
+	handler := b.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		received = string(data)
+		if r.ContentLength != int64(len(data)) || r.Header.Get("Content-Length") == "" {
+			t.Errorf("expected the length of the buffered body, got %d", r.ContentLength)
+		}
+	}))
+	for body, status := range map[string]int{"12345678": http.StatusOK, "123456789": http.StatusRequestEntityTooLarge} {
+		received = ""
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		// chunked uploads do not announce their length
+		r.ContentLength = -1
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Errorf("%s: expected %d, got %d", body, status, w.Code)
+		}
+		if status == http.StatusOK && received != body {
+			t.Errorf("expected the body to be passed on, got %q", received)
+		}
+	}
+}
+
+func TestBufferedResponse(t *testing.T) {
+	b := &Buffering{Responses: true, Memory: 4, Limit: 8, Dir: t.TempDir()}
+
+	w := httptest.NewRecorder()
+	br := b.Wrap(w)
+	br.WriteHeader(http.StatusCreated)
+	br.Write([]byte("held"))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Flushed {
+		t.Fatalf("expected the response to be held back, got %d %q", w.Code, w.Body)
+	}
+	br.Finish()
+	if w.Code != http.StatusCreated || w.Body.String() != "held" {
+		t.Fatalf("expected the response once finished, got %d %q", w.Code, w.Body)
+	}
+
+	// responses over the limit are passed through from then on
+	w = httptest.NewRecorder()
+	br = b.Wrap(w)
+	br.Write([]byte("12345"))
+	br.Write([]byte("6789"))
+	if w.Body.String() != "123456789" {
+		t.Fatalf("expected the large response to be streamed, got %q", w.Body)
+	}
+	br.Finish()
+	if w.Body.String() != "123456789" {
+		t.Fatalf("expected the response to be sent once, got %q", w.Body)
+	}
+
+	// event streams are never held back
+	w = httptest.NewRecorder()
+	br = b.Wrap(w)
+	br.Header().Set("Content-Type", "text/event-stream")
+	br.Write([]byte("data\n\n"))
+	br.Flush()
+	if w.Body.String() != "data\n\n" || !w.Flushed {
+		t.Fatalf("expected the event to be sent right away, got %q", w.Body)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Bulkhead limits the upstream requests of a route in flight at once, so that a slow
+// route cannot take up every connection of a shared pool
+type Bulkhead struct {
+	slots      chan struct{}
+	maxWaiting int64
+	maxWait    time.Duration
+	waiting    atomic.Int64
+	rejected   atomic.Int64
+}
+
+// NewBulkhead allows max concurrent requests, with up to maxWaiting more waiting for
+// at most maxWait each. It returns nil when max is not positive.
+func NewBulkhead(max int, maxWaiting int, maxWait time.Duration) *Bulkhead {
+	if max <= 0 {
+		return nil
+	}
+	return &Bulkhead{slots: make(chan struct{}, max), maxWaiting: int64(maxWaiting), maxWait: maxWait}
+}
+
+// Same reports whether both bulkheads have the same limits
+func (b *Bulkhead) Same(other *Bulkhead) bool {
+	return b != nil && other != nil && cap(b.slots) == cap(other.slots) && b.maxWaiting == other.maxWaiting && b.maxWait == other.maxWait
+}
+
+// Acquire takes a slot, waiting for one while the queue is not full. It returns false
+// when the request has to be rejected.
+func (b *Bulkhead) Acquire(ctx context.Context) bool {
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if b.waiting.Add(1) > b.maxWaiting || b.maxWait <= 0 {
+		b.waiting.Add(-1)
+		b.rejected.Add(1)
+		return false
+	}
+	defer b.waiting.Add(-1)
+	t := time.NewTimer(b.maxWait)
+	defer t.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	b.rejected.Add(1)
+	return false
+}
+
+// Release frees the slot taken by Acquire
+func (b *Bulkhead) Release() {
+	<-b.slots
+}
+
+// RouteState is the state of a route reported on the admin API
+type RouteState struct {
+	Host          string `json:"host,omitempty"`
+	Prefix        string `json:"prefix"`
+	Pool          string `json:"pool,omitempty"`
+	Static        bool   `json:"static,omitempty"`
+	Internal      bool   `json:"internal,omitempty"`
+	MaxConcurrent int    `json:"max_concurrent,omitempty"`
+	InFlight      int    `json:"in_flight"`
+	Waiting       int64  `json:"waiting"`
+	Rejected      int64  `json:"rejected"`
+}
+
+// serveRoutes reports the routes in effect with the state of their bulkheads
+func serveRoutes(w http.ResponseWriter, r *http.Request) {
+	states := []RouteState{}
+	if table := currentRoutes(); table != nil {
+		for _, route := range table.Routes {
+			state := RouteState{Host: route.Host, Prefix: route.Prefix, Static: route.Static != nil, Internal: route.Internal}
+			if route.Pool != nil {
+				state.Pool = route.Pool.Name
+			}
+			if b := route.Bulkhead; b != nil {
+				state.MaxConcurrent = cap(b.slots)
+				state.InFlight = len(b.slots)
+				state.Waiting = b.waiting.Load()
+				state.Rejected = b.rejected.Load()
+			}
+			states = append(states, state)
+		}
+	}
+	writeJSON(w, http.StatusOK, states)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func bulkheadConfig(maxConcurrent int) *Config {
+	return &Config{
+		Pools:  map[string]*PoolConfig{"api": {Servers: []*ServerConfig{{URL: "http://127.0.0.1:1"}}}},
+		Routes: []*RouteConfig{{Prefix: "/reports", Pool: "api", MaxConcurrent: maxConcurrent}},
+	}
+}
+
+func TestBulkheadKeptAcrossUpdates(t *testing.T) {
+	if err := applyConfig(bulkheadConfig(1)); err != nil {
+		t.Fatal(err)
+	}
+	defer routes.Store(nil)
+	b := currentRoutes().Routes[0].Bulkhead
+	if !b.Acquire(context.Background()) {
+		t.Fatal("expected a free slot")
+	}
+
+	if err := applyConfig(bulkheadConfig(1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentRoutes().Routes[0].Bulkhead; got != b {
+		t.Fatal("expected the bulkhead to be kept while its limits are unchanged")
+	}
+	if b.Acquire(context.Background()) {
+		t.Fatal("expected the slot in flight to still count")
+	}
+
+	if err := applyConfig(bulkheadConfig(2)); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentRoutes().Routes[0].Bulkhead; got == b || cap(got.slots) != 2 {
+		t.Fatal("expected a new bulkhead for new limits")
+	}
+}
+
+func TestBulkheadMaxWaitingRequiresMaxWait(t *testing.T) {
+	cfg := bulkheadConfig(1)
+	cfg.Routes[0].MaxWaiting = 5
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected max_waiting without max_wait to be rejected")
+	}
+	cfg.Routes[0].MaxWait = "100ms"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
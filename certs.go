@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertMonitor inspects the certificate chains https:// backends present during health
+// checks, warning once for every threshold of days left before a chain expires
+type CertMonitor struct {
+	WarnDays []int
+
+	// Enforce marks servers down whose chain expired or fails verification
+	Enforce bool
+
+	// Roots are the CAs chains verify against, nil for the system roots
+	Roots *x509.CertPool
+
+	mux    sync.Mutex
+	warned map[string]certWarning
+}
+
+// certWarning is the smallest threshold warned about for the certificate a server presents
+type certWarning struct {
+	serial string
+	level  int
+}
+
+// NewCertMonitor warns at the comma separated days before expiry, e.g. 30,7,1. Chains
+// verify against the system roots and the PEM certificates of caFile, when given.
+func NewCertMonitor(warnDays string, enforce bool, caFile string) (*CertMonitor, error) {
+	m := &CertMonitor{Enforce: enforce, warned: map[string]certWarning{}}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+		if m.Roots, err = x509.SystemCertPool(); err != nil {
+			m.Roots = x509.NewCertPool()
+		}
+		if !m.Roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA bundle %s", caFile)
+		}
+	}
+	for _, tok := range strings.Split(warnDays, ",") {
+		if tok = strings.TrimSpace(tok); tok == "" {
+			continue
+		}
+		days, err := strconv.Atoi(tok)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("invalid certificate warning threshold %q", tok)
+		}
+		m.WarnDays = append(m.WarnDays, days)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(m.WarnDays)))
+	return m, nil
+}
+
+// Check handshakes with the backend and records when its chain expires and whether it
+// verifies, returning false when the server has to be marked down
+func (m *CertMonitor) Check(b *Server) bool {
+	host := b.URL.Hostname()
+	addr := b.URL.Host
+	if b.URL.Port() == "" {
+		addr = net.JoinHostPort(host, "443")
+	}
+	_, prevErr := b.Cert()
+
+	// the chain is verified below, so that it is recorded even when it is invalid
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var conn *tls.Conn
+	raw, err := b.dial(ctx, "tcp", addr)
+	if err == nil {
+		conn = tls.Client(raw, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+		if err = conn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+		}
+	}
+	if isEgressError(err) {
+		// the proxy failed, not the backend's certificate
+		log.Printf("[%s] Certificate not checked, egress proxy failed, error: %s\n", b.URL.Host, err)
+		return true
+	}
+	if err != nil {
+		if err.Error() != prevErr {
+			log.Printf("WARNING [%s] TLS handshake failed, error: %s\n", b.URL.Host, err)
+		}
+		b.setCert(time.Time{}, err.Error())
+		return !m.Enforce
+	}
+	chain := conn.ConnectionState().PeerCertificates
+	conn.Close()
+
+	expires, err := chainExpiry(chain, x509.VerifyOptions{DNSName: host, Roots: m.Roots})
+	verifyErr := ""
+	if err != nil {
+		verifyErr = err.Error()
+		if verifyErr != prevErr {
+			log.Printf("WARNING [%s] certificate does not verify, error: %s\n", b.URL.Host, err)
+		}
+	}
+	b.setCert(expires, verifyErr)
+	m.warn(b, chain[0], expires)
+
+	if m.Enforce && (verifyErr != "" || time.Now().After(expires)) {
+		log.Printf("[%s] Marking down for its certificate\n", b.URL.Host)
+		return false
+	}
+	return true
+}
+
+// chainExpiry verifies the presented chain and returns when the verified path expires, the
+// earliest expiry of its certificates. Presented certificates off the path, such as expired
+// cross-signed roots, don't count. When the chain does not verify only the leaf counts.
+func chainExpiry(presented []*x509.Certificate, opts x509.VerifyOptions) (time.Time, error) {
+	opts.Intermediates = x509.NewCertPool()
+	for _, cert := range presented[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := presented[0].Verify(opts)
+	if err != nil {
+		return presented[0].NotAfter, err
+	}
+	// clients may take any verified path, the one lasting longest is what keeps working
+	var expires time.Time
+	for _, chain := range chains {
+		end := chain[0].NotAfter
+		for _, cert := range chain[1:] {
+			if cert.NotAfter.Before(end) {
+				end = cert.NotAfter
+			}
+		}
+		if end.After(expires) {
+			expires = end
+		}
+	}
+	return expires, nil
+}
+
+// warn logs the smallest threshold the chain crossed, unless it was logged for the certificate before
+func (m *CertMonitor) warn(b *Server, leaf *x509.Certificate, expires time.Time) {
+	days := time.Until(expires).Hours() / 24
+	level := -1
+	for _, threshold := range m.WarnDays {
+		if days <= float64(threshold) {
+			level = threshold
+		}
+	}
+	if days <= 0 {
+		level = 0
+	}
+	if level < 0 {
+		return
+	}
+	// a renewed certificate replaces the warnings of the previous one
+	serial := leaf.SerialNumber.String()
+	m.mux.Lock()
+	prev, ok := m.warned[b.URL.String()]
+	ok = ok && prev.serial == serial
+	if !ok || level < prev.level {
+		m.warned[b.URL.String()] = certWarning{serial: serial, level: level}
+	}
+	m.mux.Unlock()
+	if ok && level >= prev.level {
+		return
+	}
+	if level == 0 {
+		log.Printf("WARNING [%s] certificate chain expired at %s\n", b.URL.Host, expires.Format(time.RFC3339))
+		return
+	}
+	log.Printf("WARNING [%s] certificate chain expires in %.1f days, at %s\n", b.URL.Host, days, expires.Format(time.RFC3339))
+}
+
+// Prune forgets the warnings about servers that are no longer configured
+func (m *CertMonitor) Prune(table *RouteTable) {
+	configured := map[string]bool{}
+	for _, pool := range table.Pools {
+		for _, server := range pool.servers {
+			configured[server.URL.String()] = true
+		}
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for key := range m.warned {
+		if !configured[key] {
+			delete(m.warned, key)
+		}
+	}
+}
+
+func (b *Server) setCert(expires time.Time, err string) {
+	b.mux.Lock()
+	b.certExpires, b.certError = expires, err
+	b.mux.Unlock()
+}
+
+// Cert returns when the certificate chain of this backend expires, zero until a chain
+// was seen, and why it failed verification
+func (b *Server) Cert() (expires time.Time, err string) {
+	b.mux.RLock()
+	expires, err = b.certExpires, b.certError
+	b.mux.RUnlock()
+	return
+}
+
+// certDaysLeft returns the days until expires, nil for a zero time
+func certDaysLeft(expires time.Time) *float64 {
+	if expires.IsZero() {
+		return nil
+	}
+	days := time.Until(expires).Hours() / 24
+	return &days
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert returns a certificate for name valid until notAfter, signed by parent, self-signed without one
+func testCert(t *testing.T, name string, notAfter time.Time, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-48 * time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if !ca {
+		tmpl.DNSNames = []string{name}
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestChainExpiry(t *testing.T) {
+	now := time.Now()
+	root, rootKey := testCert(t, "Root", now.AddDate(10, 0, 0), true, nil, nil)
+	inter, interKey := testCert(t, "Intermediate", now.AddDate(0, 0, 90), true, root, rootKey)
+	leaf, _ := testCert(t, "api.example.com", now.AddDate(1, 0, 0), false, inter, interKey)
+	// an expired root still sent by the server, like DST Root CA X3
+	oldRoot, _ := testCert(t, "Old Root", now.Add(-24*time.Hour), true, nil, nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	expires, err := chainExpiry([]*x509.Certificate{leaf, inter, oldRoot}, x509.VerifyOptions{DNSName: "api.example.com", Roots: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expires.Equal(inter.NotAfter) {
+		t.Fatalf("expected the chain to expire with the intermediate at %s, got %s", inter.NotAfter, expires)
+	}
+
+	// without a trusted root only the leaf counts
+	expires, err = chainExpiry([]*x509.Certificate{leaf, inter, oldRoot}, x509.VerifyOptions{DNSName: "api.example.com", Roots: x509.NewCertPool()})
+	if err == nil || !expires.Equal(leaf.NotAfter) {
+		t.Fatalf("expected a verification error and the leaf's expiry, got %s, error %v", expires, err)
+	}
+}
+
+func TestCertMonitorPrune(t *testing.T) {
+	m, err := NewCertMonitor("30", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := selectionPool("a", "b")
+	leaf, _ := testCert(t, "api.example.com", time.Now().AddDate(0, 0, 10), false, nil, nil)
+	for _, server := range pool.servers {
+		m.warn(server, leaf, leaf.NotAfter)
+	}
+	pool.servers = pool.servers[:1]
+	m.Prune(&RouteTable{Pools: map[string]*ServerPool{"app": pool}})
+	if len(m.warned) != 1 {
+		t.Fatalf("expected only the configured server to be remembered, got %v", m.warned)
+	}
+}
+
+func TestCertMonitorCA(t *testing.T) {
+	root, rootKey := testCert(t, "Internal CA", time.Now().AddDate(10, 0, 0), true, nil, nil)
+	leaf, _ := testCert(t, "api.internal", time.Now().AddDate(1, 0, 0), false, root, rootKey)
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewCertMonitor("30", true, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chainExpiry([]*x509.Certificate{leaf}, x509.VerifyOptions{DNSName: "api.internal", Roots: m.Roots}); err != nil {
+		t.Fatalf("expected the chain to verify against the bundle, got %v", err)
+	}
+
+	os.WriteFile(file, []byte("not a certificate"), 0o600)
+	if _, err := NewCertMonitor("30", true, file); err == nil {
+		t.Fatal("expected a bundle without certificates to be rejected")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kvStub is an in-memory Consul-compatible KV store holding a single key
+type kvStub struct {
+	mux     sync.Mutex
+	index   uint64
+	value   []byte
+	changed chan struct{}
+	down    bool
+}
+
+func newKVStub() *kvStub {
+	return &kvStub{index: 1, changed: make(chan struct{})}
+}
+
+func (s *kvStub) Put(value string) {
+	s.mux.Lock()
+	s.index++
+	s.value = []byte(value)
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.mux.Unlock()
+}
+
+func (s *kvStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	index, changed, down := s.index, s.changed, s.down
+	s.mux.Unlock()
+	if down {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	// blocking query, wait for the index to move past the one the client has seen
+	if seen, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); seen >= index {
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	if s.value == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode([]struct{ Value []byte }{{s.value}})
+}
+
+const testConfig = `{"pools": {"default": {"servers": [{"url": "http://127.0.0.1:1"}]}}, "routes": [{"prefix": "/", "pool": "default"}]}`
+
+func TestKVWatcherFetch(t *testing.T) {
+	stub := newKVStub()
+	store := httptest.NewServer(stub)
+	defer store.Close()
+	k := NewKVWatcher(store.URL+"/v1/kv/lbsim/config", "")
+	k.Wait = time.Second
+
+	if _, err := k.Fetch(); err != errKeyMissing {
+		t.Fatalf("expected a missing key, got %v", err)
+	}
+	stub.Put(testConfig)
+	cfg, err := k.Fetch()
+	if err != nil || cfg == nil || len(cfg.Pools) != 1 {
+		t.Fatalf("expected the config, got %v, %v", cfg, err)
+	}
+	// without a change the blocking query returns nothing once the wait time elapsed
+	if cfg, err := k.Fetch(); cfg != nil || err != nil {
+		t.Fatalf("expected no change, got %v, %v", cfg, err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		stub.Put("{not json")
+	}()
+	if _, err := k.Fetch(); !errors.Is(err, errInvalidConfig) {
+		t.Fatalf("expected an invalid config, got %v", err)
+	}
+
+	stub.mux.Lock()
+	stub.down = true
+	stub.mux.Unlock()
+	if _, err := k.Fetch(); err == nil || errors.Is(err, errInvalidConfig) {
+		t.Fatalf("expected the store to be unavailable, got %v", err)
+	}
+}
+
+func TestKVWatcherBootstrap(t *testing.T) {
+	defer routes.Store(nil)
+	stub := newKVStub()
+	store := httptest.NewServer(stub)
+	defer store.Close()
+	cache := filepath.Join(t.TempDir(), "config.json")
+
+	k := NewKVWatcher(store.URL+"/v1/kv/lbsim/config", cache)
+	stub.Put(testConfig)
+	if !k.Bootstrap() {
+		t.Fatal("expected the config from the store to be applied")
+	}
+	if info, err := os.Stat(cache); err != nil {
+		t.Fatalf("expected the config to be cached, got %v", err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the cache to be readable by the owner only, got %v", info.Mode().Perm())
+	}
+
+	// a config that parses but does not validate falls back to the cache
+	routes.Store(nil)
+	stub.Put(`{"pools": {}, "routes": []}`)
+	k = NewKVWatcher(store.URL+"/v1/kv/lbsim/config", cache)
+	if !k.Bootstrap() || currentRoutes() == nil {
+		t.Fatal("expected the cached config to be applied")
+	}
+
+	// so does an unreachable store
+	routes.Store(nil)
+	store.Close()
+	k = NewKVWatcher(store.URL+"/v1/kv/lbsim/config", cache)
+	if !k.Bootstrap() || currentRoutes() == nil {
+		t.Fatal("expected the cached config to be applied")
+	}
+
+	routes.Store(nil)
+	k = NewKVWatcher(store.URL+"/v1/kv/lbsim/config", "")
+	if k.Bootstrap() {
+		t.Fatal("expected nothing to be applied without store and cache")
+	}
+}
+
+func TestRoutesMatchHostFirst(t *testing.T) {
+	applyConfig(&Config{
+		Pools: map[string]*PoolConfig{
+			"shop": {Servers: []*ServerConfig{{URL: "http://127.0.0.1:1"}}},
+			"api":  {Servers: []*ServerConfig{{URL: "http://127.0.0.1:2"}}},
+		},
+		Routes: []*RouteConfig{
+			{Prefix: "/api", Pool: "api"},
+			{Host: "*.example.com", Prefix: "/api", Pool: "api"},
+			{Host: "shop.example.com", Prefix: "/", Pool: "shop"},
+		},
+	})
+	defer routes.Store(nil)
+	for target, pool := range map[string]string{
+		"http://shop.example.com/api": "shop",
+		"http://blog.example.com/api": "api",
+		"http://other.org/api":        "api",
+	} {
+		route := currentRoutes().Match(httptest.NewRequest("GET", target, nil))
+		if route == nil || route.Pool.Name != pool {
+			t.Errorf("%s: expected pool %s, got %+v", target, pool, route)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	maxCostPaths int = 10000
+
+	// maxCost bounds the cost of a request, a larger reported cost is ignored
+	maxCost float64 = 1e6
+)
+
+// RequestCost estimates how expensive requests of a route are for a backend. Costs
+// are either static or learned per path from a response header of the backends.
+type RequestCost struct {
+	Static float64
+	Header string
+	mux    sync.RWMutex
+	paths  map[string]float64
+}
+
+// NewRequestCost returns the cost estimate of a route, requests cost 1 unless
+// a positive static cost is given or the header has reported a cost for their path
+func NewRequestCost(static float64, header string) *RequestCost {
+	if static <= 0 {
+		static = 1
+	}
+	return &RequestCost{Static: static, Header: http.CanonicalHeaderKey(header), paths: map[string]float64{}}
+}
+
+// Estimate returns the expected cost of the request
+func (c *RequestCost) Estimate(r *http.Request) float64 {
+	if c.Header == "" {
+		return c.Static
+	}
+	c.mux.RLock()
+	cost, ok := c.paths[r.URL.Path]
+	c.mux.RUnlock()
+	if !ok {
+		return c.Static
+	}
+	return cost
+}
+
+// Learn folds the cost reported in the response header into the estimate of the path
+func (c *RequestCost) Learn(r *http.Request, header http.Header) {
+	if c.Header == "" {
+		return
+	}
+	cost, err := strconv.ParseFloat(header.Get(c.Header), 64)
+	if err != nil || math.IsNaN(cost) || math.IsInf(cost, 0) || cost <= 0 || cost > maxCost {
+		// one bad header would corrupt the estimate of the path for good
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if old, ok := c.paths[r.URL.Path]; ok {
+		c.paths[r.URL.Path] = (old*4 + cost) / 5
+		return
+	}
+	if len(c.paths) >= maxCostPaths {
+		// paths with IDs in them would grow the map forever, start learning over
+		c.paths = map[string]float64{}
+	}
+	c.paths[r.URL.Path] = cost
+}
+
+// costWriter learns the cost the backend reported for a request and removes it from the
+// response, the cost of requests to backends is not for clients to see
+type costWriter struct {
+	http.ResponseWriter
+	cost    *RequestCost
+	r       *http.Request
+	learned bool
+}
+
+func (cw *costWriter) learn() {
+	if !cw.learned {
+		cw.learned = true
+		cw.cost.Learn(cw.r, cw.Header())
+		cw.Header().Del(cw.cost.Header)
+	}
+}
+
+func (cw *costWriter) WriteHeader(status int) {
+	if status >= http.StatusOK {
+		cw.learn()
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *costWriter) Write(b []byte) (int, error) {
+	cw.learn()
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *costWriter) Flush() {
+	cw.learn()
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *costWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
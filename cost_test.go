@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestCostLearn(t *testing.T) {
+	c := NewRequestCost(2, "x-cost")
+	r := httptest.NewRequest("GET", "/report", nil)
+	if cost := c.Estimate(r); cost != 2 {
+		t.Fatalf("expected the static cost before learning, got %v", cost)
+	}
+
+	c.Learn(r, http.Header{"X-Cost": {"10"}})
+	if cost := c.Estimate(r); cost != 10 {
+		t.Fatalf("expected the reported cost, got %v", cost)
+	}
+	c.Learn(r, http.Header{"X-Cost": {"20"}})
+	if cost := c.Estimate(r); cost != 12 {
+		t.Fatalf("expected the smoothed cost, got %v", cost)
+	}
+
+	for _, bad := range []string{"NaN", "Inf", "-Inf", "+Inf", "1e308", "0", "-5", "abc", ""} {
+		c.Learn(r, http.Header{"X-Cost": {bad}})
+		if cost := c.Estimate(r); cost != 12 {
+			t.Fatalf("cost %q changed the estimate to %v", bad, cost)
+		}
+	}
+
+	other := httptest.NewRequest("GET", "/other", nil)
+	if cost := c.Estimate(other); cost != 2 {
+		t.Fatalf("expected paths to be learned separately, got %v", cost)
+	}
+}
+
+func TestRequestCostHiddenFromClients(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cost", "40")
+		w.Write([]byte("report"))
+	}))
+	defer backend.Close()
+	applyConfig(&Config{
+		Pools:  map[string]*PoolConfig{"api": {Servers: []*ServerConfig{{URL: backend.URL}}}},
+		Routes: []*RouteConfig{{Prefix: "/", Pool: "api", CostHeader: "X-Cost"}},
+	})
+	defer routes.Store(nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/report", nil)
+	lb(w, r)
+	if w.Body.String() != "report" || w.Header().Get("X-Cost") != "" {
+		t.Fatalf("expected the response without the cost header, got %q with %v", w.Body, w.Header())
+	}
+	if cost := currentRoutes().Routes[0].Cost.Estimate(r); cost != 40 {
+		t.Fatalf("expected the reported cost to be learned, got %v", cost)
+	}
+}
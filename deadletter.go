@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DeadLetter is a request the load balancer gave up on
+type DeadLetter struct {
+	ID         string      `json:"id"`
+	Time       time.Time   `json:"time"`
+	RemoteAddr string      `json:"remote_addr"`
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	URL        string      `json:"url"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+	Truncated  bool        `json:"truncated,omitempty"`
+}
+
+// captureReader keeps the first bytes of a request body as they are read by the proxy
+type captureReader struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if room := c.limit - int64(c.buf.Len()); room > 0 {
+		c.buf.Write(p[:min(int64(n), room)])
+		if int64(n) > room {
+			c.truncated = true
+		}
+	} else if n > 0 {
+		c.truncated = true
+	}
+	return n, err
+}
+
+// DeadLetters writes requests that exhausted all attempts to a directory
+type DeadLetters struct {
+	Dir     string
+	MaxBody int64
+}
+
+// NewDeadLetters captures requests to dir, keeping up to maxBody bytes of their bodies
+func NewDeadLetters(dir string, maxBody int64) (*DeadLetters, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DeadLetters{Dir: dir, MaxBody: maxBody}, nil
+}
+
+// deadLetterRequest is what is captured of a request: the headers as the client sent
+// them, before the load balancer adds its own, and the body read so far
+type deadLetterRequest struct {
+	header http.Header
+	body   *captureReader
+}
+
+// newDeadLetterRequest copies the client's headers, without the fingerprint headers
+// the load balancer forwards to backends
+func newDeadLetterRequest(header http.Header, body *captureReader) *deadLetterRequest {
+	header = header.Clone()
+	header.Del("X-JA3")
+	header.Del("X-JA4")
+	return &deadLetterRequest{header: header, body: body}
+}
+
+// Middleware records the client's headers and the request body while it is proxied,
+// so they can be captured
+func (d *DeadLetters) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var capture *captureReader
+		if r.Body != nil && r.Body != http.NoBody {
+			capture = &captureReader{ReadCloser: r.Body, limit: d.MaxBody}
+			r.Body = capture
+		}
+		r = r.WithContext(context.WithValue(r.Context(), DeadLetterKey, newDeadLetterRequest(r.Header, capture)))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Capture writes the request to the dead letter directory, except for synthetic probes
+func (d *DeadLetters) Capture(r *http.Request) {
+	if IsProbe(r) {
+		return
+	}
+	letter := &DeadLetter{
+		ID:         newDeadLetterID(),
+		Time:       time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Host:       r.Host,
+		URL:        r.URL.RequestURI(),
+	}
+	// the load balancer's own headers, such as its bearer token, are not captured
+	req, ok := r.Context().Value(DeadLetterKey).(*deadLetterRequest)
+	if !ok {
+		req = newDeadLetterRequest(r.Header, nil)
+	}
+	letter.Header = req.header
+	if capture := req.body; capture != nil {
+		// read what the failed attempts did not send, up to the limit
+		io.Copy(io.Discard, io.LimitReader(capture, d.MaxBody-int64(capture.buf.Len())+1))
+		letter.Body, letter.Truncated = capture.buf.Bytes(), capture.truncated
+	}
+	data, err := json.MarshalIndent(letter, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(d.Dir, letter.ID+".json"), data, 0600)
+	}
+	if err != nil {
+		log.Printf("%s(%s) Failed to capture dead letter, error: %s\n", r.RemoteAddr, r.URL.Path, err)
+		return
+	}
+	log.Printf("%s(%s) Captured dead letter %s\n", r.RemoteAddr, r.URL.Path, letter.ID)
+}
+
+// newDeadLetterID returns an ID that sorts by capture time
+func newDeadLetterID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return time.Now().UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(suffix)
+}
+
+// loadDeadLetters reads the dead letters in dir, or only those with the given IDs
+func loadDeadLetters(dir string, ids []string) ([]*DeadLetter, error) {
+	if len(ids) == 0 {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			ids = append(ids, strings.TrimSuffix(filepath.Base(path), ".json"))
+		}
+	}
+	sort.Strings(ids)
+	var letters []*DeadLetter
+	for _, id := range ids {
+		data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+		if err != nil {
+			return nil, err
+		}
+		letter := &DeadLetter{}
+		if err := json.Unmarshal(data, letter); err != nil {
+			return nil, fmt.Errorf("%s: %v", id, err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// replay sends the dead letter to target, e.g. http://localhost:3030
+func (letter *DeadLetter) replay(client *http.Client, target *url.URL) (int, error) {
+	u, err := target.Parse(letter.URL)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(letter.Method, u.String(), bytes.NewReader(letter.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header = letter.Header.Clone()
+	req.Header.Del("Content-Length")
+	req.Host = letter.Host
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// replayDeadLetters replays the letters to target, removing those answered with 2xx or 3xx
+// from dir unless keep is set, and returns the number of letters kept for a later replay.
+// Other answers, such as 429 or 401, mean the request was not processed.
+func replayDeadLetters(letters []*DeadLetter, client *http.Client, target *url.URL, dir string, keep bool) int {
+	failed := 0
+	for _, letter := range letters {
+		if letter.Truncated {
+			fmt.Printf("%s skipped, body was truncated\n", letter.ID)
+			failed++
+			continue
+		}
+		status, err := letter.replay(client, target)
+		if err != nil || status < 200 || status >= 400 {
+			fmt.Printf("%s failed: %d %v\n", letter.ID, status, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s replayed: %d\n", letter.ID, status)
+		if !keep {
+			os.Remove(filepath.Join(dir, letter.ID+".json"))
+		}
+	}
+	return failed
+}
+
+// runDeadLetterCommand lists, shows or replays captured dead letters:
+//
+//	deadletters list -dir ${dir}
+//	deadletters show -dir ${dir} ${id}
+//	deadletters replay -dir ${dir} -target ${url} [-keep] [${id}...]
+func runDeadLetterCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: deadletters list|show|replay -dir ${dir} [ids]")
+	}
+	fs := flag.NewFlagSet("deadletters "+args[0], flag.ExitOnError)
+	dir := fs.String("dir", "deadletters", "Directory of captured dead letters")
+	target := fs.String("target", "http://localhost:3030", "URL of the load balancer to replay dead letters to")
+	keep := fs.Bool("keep", false, "Keep dead letters that were replayed successfully")
+	fs.Parse(args[1:])
+	letters, err := loadDeadLetters(*dir, fs.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "list":
+		for _, letter := range letters {
+			truncated := ""
+			if letter.Truncated {
+				truncated = " (body truncated)"
+			}
+			fmt.Printf("%s %s %s%s %d bytes%s\n", letter.ID, letter.Method, letter.Host, letter.URL, len(letter.Body), truncated)
+		}
+	case "show":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		for _, letter := range letters {
+			enc.Encode(letter)
+		}
+	case "replay":
+		u, err := url.Parse(*target)
+		if err != nil {
+			log.Fatal(err)
+		}
+		client := &http.Client{Timeout: 30 * time.Second}
+		failed := replayDeadLetters(letters, client, u, *dir, *keep)
+		if failed > 0 {
+			os.Exit(1)
+		}
+	default:
+		log.Fatalf("Unknown deadletters command %q", args[0])
+	}
+}
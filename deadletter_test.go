@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeadLetterCapturesClientHeaders(t *testing.T) {
+	d, err := NewDeadLetters(t.TempDir(), 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := d.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// headers the load balancer sets toward the backend
+		r.Header.Set("Authorization", "Bearer service-token")
+		r.Header.Set("X-Brownout-Level", "2")
+		d.Capture(r)
+	}))
+	r := httptest.NewRequest("POST", "/orders", strings.NewReader(`{"id": 1}`))
+	r.Header.Set("Authorization", "Bearer client-token")
+	r.Header.Set("X-JA4", "t13d1516h2_8daaf6152771_e5627efa2ab1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	paths, _ := filepath.Glob(filepath.Join(d.Dir, "*.json"))
+	if len(paths) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(paths))
+	}
+	data, _ := os.ReadFile(paths[0])
+	letter := &DeadLetter{}
+	if err := json.Unmarshal(data, letter); err != nil {
+		t.Fatal(err)
+	}
+	if got := letter.Header.Get("Authorization"); got != "Bearer client-token" {
+		t.Errorf("expected the client's Authorization header, got %q", got)
+	}
+	if letter.Header.Get("X-Brownout-Level") != "" || letter.Header.Get("X-JA4") != "" {
+		t.Errorf("expected no headers of the load balancer, got %v", letter.Header)
+	}
+	if string(letter.Body) != `{"id": 1}` {
+		t.Errorf("expected the body, got %q", letter.Body)
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	var received []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r.Host+r.URL.Path+" "+string(body))
+		switch r.URL.Path {
+		case "/ok":
+			w.WriteHeader(http.StatusCreated)
+		case "/busy":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/auth":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer target.Close()
+
+	dir := t.TempDir()
+	var letters []*DeadLetter
+	for _, path := range []string{"/ok", "/busy", "/auth", "/down", "/truncated"} {
+		letter := &DeadLetter{ID: path[1:], Method: "POST", Host: "shop.example.com", URL: path, Body: []byte("order"), Truncated: path == "/truncated"}
+		data, _ := json.Marshal(letter)
+		if err := os.WriteFile(filepath.Join(dir, letter.ID+".json"), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, letter)
+	}
+	u, _ := url.Parse(target.URL)
+	if failed := replayDeadLetters(letters, target.Client(), u, dir, false); failed != 4 {
+		t.Fatalf("expected 4 letters to be kept, got %d", failed)
+	}
+	left, err := loadDeadLetters(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, letter := range left {
+		ids = append(ids, letter.ID)
+	}
+	if strings.Join(ids, ",") != "auth,busy,down,truncated" {
+		t.Fatalf("expected only the accepted letter to be removed, got %v", ids)
+	}
+	if len(received) != 4 || received[0] != "shop.example.com/ok order" {
+		t.Fatalf("expected the letters but the truncated one to be sent with their host and body, got %q", received)
+	}
+}
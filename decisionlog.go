@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatNDJSON string = "ndjson"
+	FormatCSV    string = "csv"
+)
+
+// Candidate is the state of a server at the time a balancing decision was made
+type Candidate struct {
+	URL       string  `json:"url"`
+	Alive     bool    `json:"alive"`
+	InFlight  int     `json:"in_flight"`
+	LatencyMs float64 `json:"latency_ms"`
+	Cost      float64 `json:"cost"`
+}
+
+// Decision records a single balancing decision together with its outcome
+type Decision struct {
+	Time       time.Time   `json:"time"`
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Attempt    int         `json:"attempt"`
+	Pool       string      `json:"pool"`
+	Algorithm  string      `json:"algorithm"`
+	Candidates []Candidate `json:"candidates"`
+	Chosen     string      `json:"chosen"`
+	Status     int         `json:"status"`
+	LatencyMs  float64     `json:"latency_ms"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// DecisionLogger writes sampled balancing decisions to a file for offline analysis
+type DecisionLogger struct {
+	mux    sync.Mutex
+	file   *os.File
+	csv    *csv.Writer
+	format string
+	sample float64
+}
+
+// NewDecisionLogger appends decisions to path in the given format, keeping the sample fraction of them
+func NewDecisionLogger(path string, format string, sample float64) (*DecisionLogger, error) {
+	if format != FormatNDJSON && format != FormatCSV {
+		return nil, fmt.Errorf("unknown decision log format %q", format)
+	}
+	if sample < 0 || sample > 1 {
+		return nil, fmt.Errorf("decision sample rate must be between 0 and 1, got %v", sample)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &DecisionLogger{file: file, format: format, sample: sample}
+	if format == FormatCSV {
+		l.csv = csv.NewWriter(file)
+		if info, err := file.Stat(); err == nil && info.Size() == 0 {
+			l.csv.Write([]string{"time", "method", "path", "attempt", "pool", "algorithm", "chosen", "status", "latency_ms", "error", "candidates"})
+			l.csv.Flush()
+		}
+	}
+	return l, nil
+}
+
+// Sample reports whether the next decision should be logged
+func (l *DecisionLogger) Sample() bool {
+	return l.sample >= 1 || rand.Float64() < l.sample
+}
+
+// NewDecision captures the candidate servers of a pool before a server is chosen
+func NewDecision(r *http.Request, attempt int, pool *ServerPool) *Decision {
+	d := &Decision{
+		Time:      time.Now(),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Attempt:   attempt,
+		Pool:      pool.Name,
+		Algorithm: pool.Algorithm,
+	}
+	if d.Algorithm != LeastConnection && d.Algorithm != WeightedRoundRobin && d.Algorithm != LeastCost {
+		d.Algorithm = RoundRobin
+	}
+	for _, s := range pool.servers {
+		d.Candidates = append(d.Candidates, Candidate{
+			URL:       redactURL(s.URL),
+			Alive:     s.IsAlive(),
+			InFlight:  s.Connections(),
+			LatencyMs: milliseconds(s.Latency()),
+			Cost:      s.OutstandingCost(),
+		})
+	}
+	return d
+}
+
+// Finish records the outcome of the attempt, the first outcome recorded is kept
+func (d *Decision) Finish(status int) {
+	if d.Status == 0 {
+		d.Status = status
+		d.LatencyMs = milliseconds(time.Since(d.Time))
+	}
+}
+
+// Log writes the decision once its outcome is known
+func (l *DecisionLogger) Log(d *Decision) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.format == FormatNDJSON {
+		json.NewEncoder(l.file).Encode(d)
+		return
+	}
+	candidates := make([]string, 0, len(d.Candidates))
+	for _, c := range d.Candidates {
+		candidates = append(candidates, fmt.Sprintf("%s|%t|%d|%.3f|%g", c.URL, c.Alive, c.InFlight, c.LatencyMs, c.Cost))
+	}
+	l.csv.Write([]string{
+		d.Time.Format(time.RFC3339Nano),
+		d.Method,
+		d.Path,
+		strconv.Itoa(d.Attempt),
+		d.Pool,
+		d.Algorithm,
+		d.Chosen,
+		strconv.Itoa(d.Status),
+		strconv.FormatFloat(d.LatencyMs, 'f', 3, 64),
+		d.Error,
+		strings.Join(candidates, ";"),
+	})
+	l.csv.Flush()
+}
+
+// GetDecisionFromContext returns the decision being recorded for the request, if any
+func GetDecisionFromContext(r *http.Request) *Decision {
+	if d, ok := r.Context().Value(DecisionKey).(*Decision); ok {
+		return d
+	}
+	return nil
+}
+
+// responseRecorder remembers the status code and body size written to a ResponseWriter
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// ReplayScenario turns the first attempts of an NDJSON decision log into a playground scenario,
+// with the servers of the pool, their mean latency, the mean interval between requests and the
+// health flips seen in the log. It also returns the server chosen for every request of the scenario.
+// The first pool in the log is replayed when pool is empty.
+func ReplayScenario(log io.Reader, pool string) (*PlaygroundScenario, []string, error) {
+	sc := &PlaygroundScenario{}
+	var chosen []string
+	var first, last time.Time
+	names := map[string]string{}
+	alive := map[string]bool{}
+	latency := map[string][]float64{}
+	decoder := json.NewDecoder(log)
+	for len(chosen) < playgroundMaxRequests {
+		d := &Decision{}
+		if err := decoder.Decode(d); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("invalid decision log: %w", err)
+		}
+		if pool == "" {
+			pool = d.Pool
+		}
+		if d.Pool != pool || d.Attempt > 1 {
+			// retries are made within the first attempt, they are not requests of their own
+			continue
+		}
+		if sc.Algorithm == "" {
+			sc.Algorithm, first = d.Algorithm, d.Time
+		}
+		last = d.Time
+		request := len(chosen) + 1
+		for _, c := range d.Candidates {
+			name, ok := names[c.URL]
+			if !ok {
+				if len(names) == playgroundMaxServers {
+					return nil, nil, fmt.Errorf("pool %s has more than %d servers", pool, playgroundMaxServers)
+				}
+				name = c.URL
+				if u, err := url.Parse(c.URL); err == nil && u.Host != "" {
+					name = u.Host
+				}
+				names[c.URL] = name
+				sc.Servers = append(sc.Servers, PlaygroundServer{Name: name})
+				alive[name] = true
+			}
+			if c.Alive != alive[name] {
+				alive[name] = c.Alive
+				sc.Events = append(sc.Events, PlaygroundEvent{Request: request, Server: name, Alive: c.Alive})
+			}
+			if c.LatencyMs > 0 {
+				latency[name] = append(latency[name], c.LatencyMs)
+			}
+		}
+		name := names[d.Chosen]
+		if d.Error == "" && d.LatencyMs > 0 && name != "" {
+			latency[name] = append(latency[name], d.LatencyMs)
+		}
+		chosen = append(chosen, name)
+	}
+	if len(chosen) == 0 {
+		return nil, nil, fmt.Errorf("no decisions of pool %q in the log", pool)
+	}
+	sc.Requests = len(chosen)
+	if sc.Requests > 1 {
+		sc.IntervalMs = milliseconds(last.Sub(first)) / float64(sc.Requests-1)
+	}
+	for i := range sc.Servers {
+		samples := latency[sc.Servers[i].Name]
+		for _, ms := range samples {
+			sc.Servers[i].ServiceMs += ms / float64(len(samples))
+		}
+	}
+	return sc, chosen, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecisionLogRetry(t *testing.T) {
+	defer func(l *DecisionLogger) { decisionLog = l }(decisionLog)
+	path := filepath.Join(t.TempDir(), "decisions.ndjson")
+	var err error
+	if decisionLog, err = NewDecisionLogger(path, FormatNDJSON, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+	healthy, _ := url.Parse(backend.URL)
+	down := &url.URL{Scheme: "http", Host: "127.0.0.1:1"}
+	applyConfig(&Config{
+		Pools:  map[string]*PoolConfig{"app": {Servers: []*ServerConfig{{URL: down.String()}, {URL: healthy.String()}}}},
+		Routes: []*RouteConfig{{Prefix: "/", Pool: "app"}},
+	})
+	defer routes.Store(nil)
+
+	// round robin sends one of the requests to the server that is down
+	for range 2 {
+		w := httptest.NewRecorder()
+		lb(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusTeapot {
+			t.Fatalf("expected the backend's status, got %d", w.Code)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var decisions []Decision
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var d Decision
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		decisions = append(decisions, d)
+	}
+	if len(decisions) != 3 {
+		t.Fatalf("expected a decision per attempt, got %+v", decisions)
+	}
+	// the retry is logged first, it returns before the attempt it was made in
+	retry, failed := decisions[len(decisions)-2], decisions[len(decisions)-1]
+	if decisions[1].Chosen == down.String() {
+		retry, failed = decisions[0], decisions[1]
+	}
+	if failed.Attempt != 1 || failed.Chosen != down.String() || failed.Status != http.StatusBadGateway || failed.Error == "" {
+		t.Errorf("expected the failed attempt with its own outcome, got %+v", failed)
+	}
+	if retry.Attempt != 2 || retry.Chosen != healthy.String() || retry.Status != http.StatusTeapot || retry.Error != "" {
+		t.Errorf("expected the retry with the backend's status, got %+v", retry)
+	}
+}
+
+func TestReplayScenario(t *testing.T) {
+	log := `{"time": "2026-01-01T00:00:00Z", "attempt": 1, "pool": "app", "algorithm": "LeastConnection", "chosen": "http://a:80",
+	"latency_ms": 30, "candidates": [{"url": "http://a:80", "alive": true}, {"url": "http://b:80", "alive": true}]}
+{"time": "2026-01-01T00:00:00.01Z", "attempt": 1, "pool": "other", "chosen": "http://c:80", "candidates": [{"url": "http://c:80", "alive": true}]}
+{"time": "2026-01-01T00:00:00.05Z", "attempt": 2, "pool": "app", "chosen": "http://a:80", "candidates": [{"url": "http://a:80", "alive": true}, {"url": "http://b:80", "alive": false}]}
+{"time": "2026-01-01T00:00:00.1Z", "attempt": 1, "pool": "app", "chosen": "http://a:80",
+	"latency_ms": 10, "candidates": [{"url": "http://a:80", "alive": true}, {"url": "http://b:80", "alive": false}]}
+`
+	sc, logged, err := ReplayScenario(strings.NewReader(log), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Algorithm != LeastConnection || sc.Requests != 2 || sc.IntervalMs != 100 {
+		t.Errorf("expected 2 LeastConnection requests 100ms apart, got %+v", sc)
+	}
+	if len(sc.Servers) != 2 || sc.Servers[0].Name != "a:80" || sc.Servers[0].ServiceMs != 20 || sc.Servers[1].ServiceMs != 0 {
+		t.Errorf("expected the servers with their mean latency, got %+v", sc.Servers)
+	}
+	if len(sc.Events) != 1 || sc.Events[0] != (PlaygroundEvent{Request: 2, Server: "b:80", Alive: false}) {
+		t.Errorf("expected b to go down at the second request, got %+v", sc.Events)
+	}
+	if len(logged) != 2 || logged[0] != "a:80" || logged[1] != "a:80" {
+		t.Errorf("expected the logged choices, got %v", logged)
+	}
+	if _, err := sc.Simulate(); err != nil {
+		t.Errorf("expected the scenario to simulate, got %v", err)
+	}
+
+	if _, _, err := ReplayScenario(strings.NewReader(log), "missing"); err == nil {
+		t.Error("expected an error without decisions of the pool")
+	}
+}
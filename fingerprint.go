@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxClientHello int = 1 << 16
+
+	extServerName          uint16 = 0x0000
+	extSupportedGroups     uint16 = 0x000a
+	extPointFormats        uint16 = 0x000b
+	extSignatureAlgorithms uint16 = 0x000d
+	extALPN                uint16 = 0x0010
+	extSupportedVersions   uint16 = 0x002b
+)
+
+// TLSFingerprint identifies the TLS stack of a client by its ClientHello
+type TLSFingerprint struct {
+	JA3     string
+	JA3Hash string
+	JA4     string
+}
+
+// clientHello holds the ClientHello fields fingerprints are computed from
+type clientHello struct {
+	version             uint16
+	ciphers             []uint16
+	extensions          []uint16
+	groups              []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	supportedVersions   []uint16
+	alpn                []string
+	sni                 bool
+}
+
+// fingerprintListener wraps accepted connections so their ClientHello can be fingerprinted
+type fingerprintListener struct {
+	net.Listener
+}
+
+func (l fingerprintListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &fingerprintConn{Conn: c}, nil
+}
+
+// fingerprintConn captures the ClientHello on first read and replays it to the TLS server
+type fingerprintConn struct {
+	net.Conn
+	once        sync.Once
+	buf         []byte
+	fingerprint *TLSFingerprint
+}
+
+func (c *fingerprintConn) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		c.buf = readClientHello(c.Conn)
+		if hello, err := parseClientHello(c.buf); err == nil {
+			c.fingerprint = hello.fingerprint()
+		}
+	})
+	if len(c.buf) > 0 {
+		n := copy(p, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// readClientHello reads TLS records until a complete handshake message has been received
+func readClientHello(r io.Reader) []byte {
+	var buf []byte
+	need := 0
+	for len(buf) < maxClientHello {
+		header := make([]byte, 5)
+		if n, err := io.ReadFull(r, header); err != nil {
+			// replay what was read, the TLS server reports the short record
+			return append(buf, header[:n]...)
+		}
+		buf = append(buf, header...)
+		if header[0] != 0x16 {
+			return buf
+		}
+		record := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+		n, _ := io.ReadFull(r, record)
+		buf = append(buf, record[:n]...)
+		if n < len(record) {
+			return buf
+		}
+		handshake := handshakeBytes(buf)
+		if need == 0 && len(handshake) >= 4 {
+			need = 4 + (int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3]))
+		}
+		if need > 0 && len(handshake) >= need {
+			return buf
+		}
+	}
+	return buf
+}
+
+// handshakeBytes strips record headers from a sequence of handshake records
+func handshakeBytes(records []byte) []byte {
+	var out []byte
+	for len(records) >= 5 {
+		n := int(binary.BigEndian.Uint16(records[3:5]))
+		if len(records) < 5+n {
+			n = len(records) - 5
+		}
+		out = append(out, records[5:5+n]...)
+		records = records[5+n:]
+	}
+	return out
+}
+
+var errMalformedHello = errors.New("malformed ClientHello")
+
+// reader consumes big endian fields from a ClientHello
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errMalformedHello
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *reader) uint16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+func (r *reader) uint16s(b []byte) []uint16 {
+	var out []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		out = append(out, binary.BigEndian.Uint16(b[i:]))
+	}
+	return out
+}
+
+// parseClientHello extracts the fingerprinted fields from the raw TLS records of a ClientHello
+func parseClientHello(records []byte) (*clientHello, error) {
+	r := &reader{data: handshakeBytes(records)}
+	if r.uint8() != 1 {
+		return nil, errMalformedHello
+	}
+	r.bytes(3)
+	hello := &clientHello{version: uint16(r.uint16())}
+	r.bytes(32)
+	r.bytes(r.uint8())
+	hello.ciphers = r.uint16s(r.bytes(r.uint16()))
+	r.bytes(r.uint8())
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) == 0 {
+		return hello, nil
+	}
+
+	exts := &reader{data: r.bytes(r.uint16())}
+	for exts.err == nil && len(exts.data) > 0 {
+		typ := uint16(exts.uint16())
+		ext := &reader{data: exts.bytes(exts.uint16())}
+		hello.extensions = append(hello.extensions, typ)
+		switch typ {
+		case extServerName:
+			hello.sni = true
+		case extSupportedGroups:
+			hello.groups = ext.uint16s(ext.bytes(ext.uint16()))
+		case extPointFormats:
+			hello.pointFormats = ext.bytes(ext.uint8())
+		case extSignatureAlgorithms:
+			hello.signatureAlgorithms = ext.uint16s(ext.bytes(ext.uint16()))
+		case extSupportedVersions:
+			hello.supportedVersions = ext.uint16s(ext.bytes(ext.uint8()))
+		case extALPN:
+			list := &reader{data: ext.bytes(ext.uint16())}
+			for list.err == nil && len(list.data) > 0 {
+				hello.alpn = append(hello.alpn, string(list.bytes(list.uint8())))
+			}
+		}
+	}
+	if r.err != nil || exts.err != nil {
+		return nil, errMalformedHello
+	}
+	return hello, nil
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinValues(values []uint16, format string, sep string) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, fmt.Sprintf(format, v))
+	}
+	return strings.Join(parts, sep)
+}
+
+// truncatedHash returns the first 12 hex characters of the SHA256 of s
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// fingerprint computes the JA3 and JA4 fingerprints of the ClientHello
+func (h *clientHello) fingerprint() *TLSFingerprint {
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+
+	points := make([]uint16, 0, len(h.pointFormats))
+	for _, p := range h.pointFormats {
+		points = append(points, uint16(p))
+	}
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinValues(ciphers, "%d", "-"),
+		joinValues(extensions, "%d", "-"),
+		joinValues(withoutGREASE(h.groups), "%d", "-"),
+		joinValues(points, "%d", "-"),
+	}, ",")
+	sum := md5.Sum([]byte(ja3))
+
+	version := h.version
+	if supported := withoutGREASE(h.supportedVersions); len(supported) > 0 {
+		version = 0
+		for _, v := range supported {
+			version = max(version, v)
+		}
+	}
+	versions := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3", 0x0002: "s2"}
+	tlsVersion, ok := versions[version]
+	if !ok {
+		tlsVersion = "00"
+	}
+	sni := "i"
+	if h.sni {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first, last := h.alpn[0][0], h.alpn[0][len(h.alpn[0])-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			encoded := hex.EncodeToString([]byte(h.alpn[0]))
+			alpn = encoded[:1] + encoded[len(encoded)-1:]
+		}
+	}
+
+	sortedCiphers := append([]uint16{}, ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+	var sortedExtensions []uint16
+	for _, e := range extensions {
+		if e != extServerName && e != extALPN {
+			sortedExtensions = append(sortedExtensions, e)
+		}
+	}
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+	extensionPart := joinValues(sortedExtensions, "%04x", ",")
+	if len(h.signatureAlgorithms) > 0 && extensionPart != "" {
+		extensionPart += "_" + joinValues(withoutGREASE(h.signatureAlgorithms), "%04x", ",")
+	}
+
+	ja4 := fmt.Sprintf("t%s%s%02d%02d%s_%s_%s",
+		tlsVersion, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn,
+		truncatedHash(joinValues(sortedCiphers, "%04x", ",")),
+		truncatedHash(extensionPart))
+
+	return &TLSFingerprint{JA3: ja3, JA3Hash: hex.EncodeToString(sum[:]), JA4: ja4}
+}
+
+func isAlphanumeric(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z')
+}
+
+// fingerprintConnContext makes the connection's fingerprint reachable from its requests
+func fingerprintConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		if fc, ok := tc.NetConn().(*fingerprintConn); ok {
+			return context.WithValue(ctx, FingerprintKey, fc)
+		}
+	}
+	return ctx
+}
+
+// GetFingerprintFromContext returns the TLS fingerprint of the request's connection, if known
+func GetFingerprintFromContext(r *http.Request) *TLSFingerprint {
+	if fc, ok := r.Context().Value(FingerprintKey).(*fingerprintConn); ok {
+		return fc.fingerprint
+	}
+	return nil
+}
+
+// FingerprintPolicy applies access control, rate limits and logging by TLS fingerprint
+type FingerprintPolicy struct {
+	deny    map[string]bool
+	rate    float64
+	log     bool
+	mux     sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket allows rate requests per second with bursts of up to rate requests
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewFingerprintPolicy denies the comma separated JA3 hashes or JA4 fingerprints and
+// limits every fingerprint to rate requests per second when rate is positive
+func NewFingerprintPolicy(deny string, rate float64, logRequests bool) *FingerprintPolicy {
+	p := &FingerprintPolicy{deny: map[string]bool{}, rate: rate, log: logRequests, buckets: map[string]*tokenBucket{}}
+	for _, fp := range strings.Split(deny, ",") {
+		if fp = strings.TrimSpace(fp); fp != "" {
+			p.deny[fp] = true
+		}
+	}
+	return p
+}
+
+// allow takes a token from the fingerprint's bucket
+func (p *FingerprintPolicy) allow(key string) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	now := time.Now()
+	b, ok := p.buckets[key]
+	if !ok {
+		if len(p.buckets) > 10000 {
+			for k, idle := range p.buckets {
+				if now.Sub(idle.last) > time.Minute {
+					delete(p.buckets, k)
+				}
+			}
+		}
+		b = &tokenBucket{tokens: p.rate, last: now}
+		p.buckets[key] = b
+	}
+	b.tokens = min(p.rate, b.tokens+now.Sub(b.last).Seconds()*p.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Middleware enforces the policy and forwards the fingerprints to backends as headers.
+// Fingerprint headers sent by clients are always removed, also on plain HTTP.
+func (p *FingerprintPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("X-JA3")
+		r.Header.Del("X-JA4")
+		fp := GetFingerprintFromContext(r)
+		if fp == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if p.log {
+			log.Printf("%s(%s) ja3=%s ja4=%s\n", r.RemoteAddr, r.URL.Path, fp.JA3Hash, fp.JA4)
+		}
+		if p.deny[fp.JA3Hash] || p.deny[fp.JA4] {
+			log.Printf("%s(%s) Denied TLS fingerprint %s\n", r.RemoteAddr, r.URL.Path, fp.JA4)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if p.rate > 0 && !p.allow(fp.JA4) {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		r.Header.Set("X-JA3", fp.JA3Hash)
+		r.Header.Set("X-JA4", fp.JA4)
+		next.ServeHTTP(w, r)
+	})
+}
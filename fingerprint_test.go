@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+type testExtension struct {
+	typ  uint16
+	data []byte
+}
+
+func u16s(values ...uint16) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+// withLength16 prefixes b with its length as a uint16
+func withLength16(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+}
+
+// buildClientHello returns the TLS record of a ClientHello
+func buildClientHello(version uint16, ciphers []uint16, extensions []testExtension) []byte {
+	body := binary.BigEndian.AppendUint16(nil, version)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0)
+	body = append(body, withLength16(u16s(ciphers...))...)
+	body = append(body, 1, 0)
+	var exts []byte
+	for _, ext := range extensions {
+		exts = binary.BigEndian.AppendUint16(exts, ext.typ)
+		exts = append(exts, withLength16(ext.data)...)
+	}
+	body = append(body, withLength16(exts)...)
+
+	handshake := append([]byte{1, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	return append([]byte{0x16, 3, 1}, withLength16(handshake)...)
+}
+
+func TestJA3(t *testing.T) {
+	// the example of the JA3 reference implementation
+	record := buildClientHello(769,
+		[]uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		[]testExtension{
+			{typ: extServerName, data: withLength16(append([]byte{0}, withLength16([]byte("example.com"))...))},
+			{typ: extSupportedGroups, data: withLength16(u16s(23, 24, 25))},
+			{typ: extPointFormats, data: []byte{1, 0}},
+		})
+	hello, err := parseClientHello(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := hello.fingerprint()
+	if want := "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0"; fp.JA3 != want {
+		t.Errorf("JA3 %s, expected %s", fp.JA3, want)
+	}
+	if want := "ada70206e40642a3e4461f35503241d5"; fp.JA3Hash != want {
+		t.Errorf("JA3 hash %s, expected %s", fp.JA3Hash, want)
+	}
+}
+
+func TestJA4(t *testing.T) {
+	// the Chrome example of the JA4 technical details, with GREASE values added
+	ciphers := []uint16{0x2a2a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+	extensions := []testExtension{
+		{typ: 0x3a3a},
+		{typ: extServerName, data: withLength16(append([]byte{0}, withLength16([]byte("example.com"))...))},
+		{typ: 0x0017}, {typ: 0xff01, data: []byte{0}},
+		{typ: extSupportedGroups, data: withLength16(u16s(0x4a4a, 0x001d, 0x0017, 0x0018))},
+		{typ: extPointFormats, data: []byte{1, 0}},
+		{typ: 0x0023},
+		{typ: extALPN, data: withLength16(append(append([]byte{2}, "h2"...), append([]byte{8}, "http/1.1"...)...))},
+		{typ: 0x0005, data: []byte{1, 0, 0, 0, 0}},
+		{typ: extSignatureAlgorithms, data: withLength16(u16s(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601))},
+		{typ: 0x0012}, {typ: 0x0033, data: withLength16(nil)}, {typ: 0x002d, data: []byte{1, 1}},
+		{typ: extSupportedVersions, data: append([]byte{6}, u16s(0x5a5a, 0x0304, 0x0303)...)},
+		{typ: 0x001b, data: []byte{2, 0, 2}}, {typ: 0x4469, data: withLength16(nil)}, {typ: 0x0015, data: make([]byte, 10)},
+		{typ: 0x1a1a, data: []byte{0}},
+	}
+	hello, err := parseClientHello(buildClientHello(0x0303, ciphers, extensions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "t13d1516h2_8daaf6152771_e5627efa2ab1", hello.fingerprint().JA4; got != want {
+		t.Errorf("JA4 %s, expected %s", got, want)
+	}
+}
+
+func TestReadClientHello(t *testing.T) {
+	record := buildClientHello(0x0303, []uint16{0x1301}, nil)
+	// split across two records, followed by application data that must not be read
+	handshake := record[5:]
+	first := append([]byte{0x16, 3, 1}, withLength16(handshake[:10])...)
+	second := append([]byte{0x16, 3, 1}, withLength16(handshake[10:])...)
+	stream := append(append(first, second...), "more"...)
+	got := readClientHello(bytes.NewReader(stream))
+	if !bytes.Equal(got, stream[:len(first)+len(second)]) {
+		t.Fatalf("read %d bytes, expected both records", len(got))
+	}
+	if _, err := parseClientHello(got); err != nil {
+		t.Fatal(err)
+	}
+
+	// a short record header is replayed as it was read
+	if got := readClientHello(io.LimitReader(bytes.NewReader(record), 3)); !bytes.Equal(got, record[:3]) {
+		t.Fatalf("read %v, expected %v", got, record[:3])
+	}
+}
+
+func TestRouteFingerprints(t *testing.T) {
+	cfg := &Config{
+		Pools: map[string]*PoolConfig{
+			"web":    {Servers: []*ServerConfig{{URL: "http://127.0.0.1:1"}}},
+			"tarpit": {Servers: []*ServerConfig{{URL: "http://127.0.0.1:2"}}},
+		},
+		Routes: []*RouteConfig{{Prefix: "/", Pool: "web"}, {Prefix: "/", Pool: "tarpit", Fingerprints: []string{"bot"}}},
+	}
+	if err := applyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer routes.Store(nil)
+	for ja4, pool := range map[string]string{"": "web", "browser": "web", "bot": "tarpit"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if ja4 != "" {
+			fc := &fingerprintConn{fingerprint: &TLSFingerprint{JA4: ja4}}
+			r = r.WithContext(context.WithValue(r.Context(), FingerprintKey, fc))
+		}
+		if route := currentRoutes().Match(r); route.Pool.Name != pool {
+			t.Errorf("fingerprint %q routed to %s, expected %s", ja4, route.Pool.Name, pool)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	grpcWebContentType     string = "application/grpc-web"
+	grpcWebTextContentType string = "application/grpc-web-text"
+	grpcUnavailable        string = "14"
+)
+
+// grpcWebMaxBody is the largest gRPC-Web request body read, in bytes
+var grpcWebMaxBody int64 = 4 << 20
+
+// newGRPCTransport returns a transport speaking HTTP/2 to a backend, without TLS for
+// http:// servers, that connects through dial
+func newGRPCTransport(dial func(ctx context.Context, network string, addr string) (net.Conn, error)) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dial
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t
+}
+
+// isGRPCWeb returns true for gRPC-Web requests in binary or text encoding
+func isGRPCWeb(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), grpcWebContentType)
+}
+
+// isGRPCWebPreflight returns true for CORS preflights of gRPC-Web requests
+func isGRPCWebPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// grpcWebAllowedHeaders are the request headers gRPC-Web clients may send from other origins
+const grpcWebAllowedHeaders string = "content-type, x-grpc-web, x-user-agent, grpc-timeout, authorization"
+
+// setGRPCWebCORS allows browsers on the request's origin to read gRPC-Web responses,
+// when the origin is one of the allowed origins
+func setGRPCWebCORS(w http.ResponseWriter, r *http.Request, origins map[string]bool) bool {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !origins[strings.ToLower(origin)] {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Expose-Headers", "grpc-status, grpc-message, grpc-status-details-bin")
+	return true
+}
+
+// serveGRPCWebPreflight answers a CORS preflight without involving backends, origins that
+// are not allowed get no CORS headers, so browsers do not send the request
+func serveGRPCWebPreflight(w http.ResponseWriter, r *http.Request, origins map[string]bool) {
+	if setGRPCWebCORS(w, r, origins) {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", grpcWebAllowedHeaders)
+		w.Header().Set("Access-Control-Max-Age", "86400")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeGRPCWebText decodes a base64 body made of independently padded chunks
+func decodeGRPCWebText(body []byte) ([]byte, error) {
+	var out []byte
+	body = bytes.Join(bytes.Fields(body), nil)
+	for len(body) > 0 {
+		// a chunk ends after its padding, or at the end of the body
+		end := len(body)
+		if i := bytes.IndexByte(body, '='); i >= 0 {
+			end = i
+			for end < len(body) && body[end] == '=' {
+				end++
+			}
+		}
+		chunk, err := base64.StdEncoding.DecodeString(string(body[:end]))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk...)
+		body = body[end:]
+	}
+	return out, nil
+}
+
+// grpcWebWriter writes gRPC-Web frames to the client, base64 encoded for text clients
+type grpcWebWriter struct {
+	w    http.ResponseWriter
+	text bool
+}
+
+func (g *grpcWebWriter) Write(p []byte) (int, error) {
+	out := p
+	if g.text {
+		out = []byte(base64.StdEncoding.EncodeToString(p))
+	}
+	if _, err := g.w.Write(out); err != nil {
+		return 0, err
+	}
+	if f, ok := g.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return len(p), nil
+}
+
+// writeTrailers sends the gRPC trailers as a gRPC-Web trailer frame
+func (g *grpcWebWriter) writeTrailers(trailers http.Header) {
+	var block bytes.Buffer
+	for key, values := range trailers {
+		for _, value := range values {
+			block.WriteString(strings.ToLower(key) + ": " + value + "\r\n")
+		}
+	}
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = 0x80
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	g.Write(append(frame, block.Bytes()...))
+}
+
+// serveGRPCWeb translates a gRPC-Web request into a gRPC request to the server and
+// the gRPC response, including its trailers, back into gRPC-Web, readable by browsers on
+// the allowed origins
+func serveGRPCWeb(w http.ResponseWriter, r *http.Request, server *Server, origins map[string]bool) {
+	contentType := r.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, grpcWebMaxBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "gRPC-Web request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err == nil && text {
+		body, err = decodeGRPCWebText(body)
+	}
+	if err != nil {
+		http.Error(w, "Malformed gRPC-Web request", http.StatusBadRequest)
+		return
+	}
+
+	target := *server.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "Malformed gRPC-Web request", http.StatusBadRequest)
+		return
+	}
+	for key, values := range r.Header {
+		switch http.CanonicalHeaderKey(key) {
+		case "Content-Type", "Content-Length", "Accept", "Origin", "Referer", "X-Grpc-Web", "X-User-Agent", "Connection":
+			continue
+		}
+		req.Header[key] = values
+	}
+	subtype := strings.TrimPrefix(strings.TrimPrefix(contentType, grpcWebTextContentType), grpcWebContentType)
+	req.Header.Set("Content-Type", "application/grpc"+subtype)
+	req.Header.Set("Te", "trailers")
+
+	setGRPCWebCORS(w, r, origins)
+	respType := grpcWebContentType + subtype
+	if text {
+		respType = grpcWebTextContentType + subtype
+	}
+	out := &grpcWebWriter{w: w, text: text}
+
+	resp, err := server.grpcTransport.RoundTrip(req)
+	if err != nil {
+		log.Printf("[%s] %s\n", server.URL.Host, err)
+		if !isEgressError(err) {
+			server.countFailure()
+		}
+		w.Header().Set("Content-Type", respType)
+		w.Header().Set("Grpc-Status", grpcUnavailable)
+		w.Header().Set("Grpc-Message", "backend unavailable")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		switch http.CanonicalHeaderKey(key) {
+		case "Content-Type", "Content-Length", "Trailer":
+			continue
+		}
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Type", respType)
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		log.Printf("[%s] %s\n", server.URL.Host, err)
+		return
+	}
+	if len(resp.Trailer) > 0 {
+		out.writeTrailers(resp.Trailer)
+	}
+}
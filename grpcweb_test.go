@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGRPCWebBodyLimit(t *testing.T) {
+	defer func(limit int64) { grpcWebMaxBody = limit }(grpcWebMaxBody)
+	grpcWebMaxBody = 16
+	server := NewServer(&url.URL{Scheme: "http", Host: "127.0.0.1:1"}, "grpc")
+
+	r := httptest.NewRequest("POST", "/pkg.Service/Method", bytes.NewReader(make([]byte, 17)))
+	r.Header.Set("Content-Type", grpcWebContentType)
+	w := httptest.NewRecorder()
+	serveGRPCWeb(w, r, server, nil)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a body over the limit, got %d", w.Code)
+	}
+}
+
+func TestGRPCWebPreflight(t *testing.T) {
+	origins := map[string]bool{"https://app.example.com": true}
+	for origin, allowed := range map[string]bool{"https://APP.example.com": true, "https://evil.example": false, "": false} {
+		r := httptest.NewRequest("OPTIONS", "/pkg.Service/Method", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		r.Header.Set("Access-Control-Request-Headers", "x-anything")
+		w := httptest.NewRecorder()
+		serveGRPCWebPreflight(w, r, origins)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("%q: expected 204, got %d", origin, w.Code)
+		}
+		expected := ""
+		if allowed {
+			expected = origin
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != expected {
+			t.Errorf("%q: expected allowed %v, got Access-Control-Allow-Origin %q", origin, allowed, got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); (got == "true") != allowed {
+			t.Errorf("%q: expected credentials allowed %v, got %q", origin, allowed, got)
+		}
+		if allowed && w.Header().Get("Access-Control-Allow-Headers") != grpcWebAllowedHeaders {
+			t.Errorf("%q: expected the fixed headers, got %q", origin, w.Header().Get("Access-Control-Allow-Headers"))
+		}
+	}
+}
+
+func TestGRPCWebBridge(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc+proto" || r.Header.Get("Te") != "trailers" {
+			t.Errorf("expected a gRPC request over HTTP/2, got %s %v", r.Proto, r.Header)
+		}
+		if r.Header.Get("X-Grpc-Web") != "" || r.Header.Get("Origin") != "" {
+			t.Errorf("expected the gRPC-Web headers to be left out, got %v", r.Header)
+		}
+		message, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(message)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	server := NewServer(target, "grpc")
+
+	message := []byte{0, 0, 0, 0, 2, 8, 1}
+	trailer := append([]byte{0x80, 0, 0, 0, 16}, "grpc-status: 0\r\n"...)
+	for contentType, encode := range map[string]func([]byte) []byte{
+		grpcWebContentType + "+proto": func(b []byte) []byte { return b },
+		grpcWebTextContentType + "+proto": func(b []byte) []byte {
+			return []byte(base64.StdEncoding.EncodeToString(b))
+		},
+	} {
+		r := httptest.NewRequest("POST", "/pkg.Service/Method", bytes.NewReader(encode(message)))
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("X-Grpc-Web", "1")
+		r.Header.Set("Origin", "https://app.example.com")
+		w := httptest.NewRecorder()
+		serveGRPCWeb(w, r, server, map[string]bool{"https://app.example.com": true})
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentType {
+			t.Fatalf("%s: expected 200 in the request's encoding, got %d %s", contentType, w.Code, w.Header().Get("Content-Type"))
+		}
+		expected := append(encode(message), encode(trailer)...)
+		if !bytes.Equal(w.Body.Bytes(), expected) {
+			t.Errorf("%s: expected the message and the trailer frame, got %q", contentType, w.Body)
+		}
+		if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+			t.Errorf("%s: expected the allowed origin to read the response", contentType)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	historyStep      time.Duration = 10 * time.Second
+	historyFinePts   int           = 360  // one hour of 10s points
+	historyCoarsePts int           = 1440 // one day of 1m points
+	historyDownscale int           = 6    // 10s points per 1m point
+)
+
+// HistoryPoint is the value of a metric over one step, t is the unix time the step ended at
+type HistoryPoint struct {
+	T int64   `json:"t"`
+	V float64 `json:"v"`
+}
+
+// ring keeps the latest points of a series, overwriting the oldest
+type ring struct {
+	points []HistoryPoint
+	next   int
+	full   bool
+}
+
+func newRing(size int) ring {
+	return ring{points: make([]HistoryPoint, size)}
+}
+
+func (r *ring) add(p HistoryPoint) {
+	r.points[r.next] = p
+	r.next = (r.next + 1) % len(r.points)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// since returns the points at or after t, oldest first
+func (r *ring) since(t int64) []HistoryPoint {
+	var ordered []HistoryPoint
+	if r.full {
+		ordered = append(ordered, r.points[r.next:]...)
+	}
+	ordered = append(ordered, r.points[:r.next]...)
+	i := sort.Search(len(ordered), func(i int) bool {
+		return ordered[i].T >= t
+	})
+	return ordered[i:]
+}
+
+// historySeries holds one metric at 10s resolution for the last hour and
+// downsampled to 1m resolution for the last day
+type historySeries struct {
+	counter bool
+	last    int64
+	seeded  bool
+	fine    ring
+	coarse  ring
+	pending []float64
+	updated time.Time
+}
+
+// add appends the value of a step. Counters are stored as the increase over the step,
+// downsampled by summing; gauges are downsampled by averaging.
+func (s *historySeries) add(now time.Time, value float64) {
+	s.updated = now
+	if s.counter {
+		total := int64(value)
+		increase := total - s.last
+		if !s.seeded || increase < 0 {
+			// first sample or the server was replaced, there is no increase to report yet
+			increase = 0
+		}
+		s.last, s.seeded = total, true
+		value = float64(increase)
+	}
+	s.fine.add(HistoryPoint{T: now.Unix(), V: value})
+	s.pending = append(s.pending, value)
+	if len(s.pending) < historyDownscale {
+		return
+	}
+	sum := 0.0
+	for _, v := range s.pending {
+		sum += v
+	}
+	if !s.counter {
+		sum /= float64(len(s.pending))
+	}
+	s.coarse.add(HistoryPoint{T: now.Unix(), V: sum})
+	s.pending = s.pending[:0]
+}
+
+// MetricsHistory samples pool and server metrics every 10 seconds and keeps them in memory
+type MetricsHistory struct {
+	mux    sync.Mutex
+	series map[string]map[string]*historySeries
+}
+
+// NewMetricsHistory creates an empty history
+func NewMetricsHistory() *MetricsHistory {
+	return &MetricsHistory{series: map[string]map[string]*historySeries{}}
+}
+
+// Run samples the metrics of the routes in effect every step
+func (h *MetricsHistory) Run() {
+	t := time.NewTicker(historyStep)
+	for {
+		select {
+		case now := <-t.C:
+			h.Sample(now)
+		}
+	}
+}
+
+// Sample records the current metrics of every pool and server
+func (h *MetricsHistory) Sample(now time.Time) {
+	table := currentRoutes()
+	if table == nil {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for name, pool := range table.Pools {
+		var requests, failures int64
+		connections, alive := 0, 0
+		for _, server := range pool.servers {
+			r, f := server.Counters()
+			up := 0.0
+			if server.IsAlive() {
+				up = 1
+				alive++
+			}
+			target := "server " + name + " " + redactURL(server.URL)
+			h.add(target, "requests", true, now, float64(r))
+			h.add(target, "failures", true, now, float64(f))
+			h.add(target, "egress_failures", true, now, float64(server.EgressFailures()))
+			h.add(target, "connections", false, now, float64(server.Connections()))
+			h.add(target, "latency_ms", false, now, milliseconds(server.Latency()))
+			h.add(target, "rtt_ms", false, now, milliseconds(server.RTT()))
+			if expires, _ := server.Cert(); !expires.IsZero() {
+				h.add(target, "cert_days_left", false, now, *certDaysLeft(expires))
+			}
+			h.add(target, "alive", false, now, up)
+			requests, failures, connections = requests+r, failures+f, connections+server.Connections()
+		}
+		target := "pool " + name
+		h.add(target, "requests", true, now, float64(requests))
+		h.add(target, "failures", true, now, float64(failures))
+		h.add(target, "connections", false, now, float64(connections))
+		h.add(target, "alive_servers", false, now, float64(alive))
+		h.add(target, "utilization", false, now, pool.Utilization())
+		h.add(target, "brownout_level", false, now, float64(pool.BrownoutLevel()))
+	}
+	if prober != nil {
+		for _, state := range prober.States() {
+			if state.Runs > 0 {
+				h.add("probe "+state.Name, "availability", false, now, state.Availability)
+				h.add("probe "+state.Name, "latency_ms", false, now, state.LatencyMs)
+			}
+		}
+		for route, availability := range prober.RouteAvailability() {
+			h.add("route "+route, "probe_availability", false, now, availability)
+		}
+	}
+	for target, metrics := range h.series {
+		for metric, s := range metrics {
+			if now.Sub(s.updated) > 24*time.Hour {
+				delete(metrics, metric)
+			}
+		}
+		if len(metrics) == 0 {
+			delete(h.series, target)
+		}
+	}
+}
+
+func (h *MetricsHistory) add(target string, metric string, counter bool, now time.Time, value float64) {
+	metrics, ok := h.series[target]
+	if !ok {
+		metrics = map[string]*historySeries{}
+		h.series[target] = metrics
+	}
+	s, ok := metrics[metric]
+	if !ok {
+		s = &historySeries{counter: counter, fine: newRing(historyFinePts), coarse: newRing(historyCoarsePts)}
+		metrics[metric] = s
+	}
+	s.add(now, value)
+}
+
+// HistorySeries is the queried history of one metric
+type HistorySeries struct {
+	Pool   string         `json:"pool"`
+	Server string         `json:"server,omitempty"`
+	Metric string         `json:"metric"`
+	Step   string         `json:"step"`
+	Points []HistoryPoint `json:"points"`
+}
+
+// Query returns the history of the metric since the given time for a pool, or for a
+// server of the pool when server is not empty. Points are 10s apart for the last hour
+// and 1m apart for anything older.
+func (h *MetricsHistory) Query(pool string, server string, metric string, since time.Time) (*HistorySeries, error) {
+	target := "pool " + pool
+	if server != "" {
+		target = "server " + pool + " " + server
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	s, ok := h.series[target][metric]
+	if !ok {
+		return nil, fmt.Errorf("no history of %s for %s", metric, target)
+	}
+	result := &HistorySeries{Pool: pool, Server: server, Metric: metric, Step: historyStep.String()}
+	if time.Since(since) <= time.Duration(historyFinePts)*historyStep {
+		result.Points = s.fine.since(since.Unix())
+	} else {
+		result.Step = (historyStep * time.Duration(historyDownscale)).String()
+		result.Points = s.coarse.since(since.Unix())
+	}
+	return result, nil
+}
+
+// ServeHTTP lists the recorded series, or returns the history of the series selected
+// with the pool, server, metric and since (a duration, default 1h) query parameters
+func (h *MetricsHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("metric") == "" {
+		h.mux.Lock()
+		series := map[string][]string{}
+		for target, metrics := range h.series {
+			for metric := range metrics {
+				series[target] = append(series[target], metric)
+			}
+			sort.Strings(series[target])
+		}
+		h.mux.Unlock()
+		writeJSON(w, http.StatusOK, series)
+		return
+	}
+	since := time.Hour
+	if v := q.Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid since duration " + v})
+			return
+		}
+		since = d
+	}
+	result, err := h.Query(q.Get("pool"), q.Get("server"), strings.ToLower(q.Get("metric")), time.Now().Add(-since))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
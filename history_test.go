@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHistorySeriesDownsampling(t *testing.T) {
+	start := time.Unix(1000, 0)
+	counter := &historySeries{counter: true, fine: newRing(3), coarse: newRing(historyCoarsePts)}
+	gauge := &historySeries{fine: newRing(3), coarse: newRing(historyCoarsePts)}
+	for i, v := range []float64{10, 15, 15, 20, 30, 5} {
+		now := start.Add(time.Duration(i) * historyStep)
+		counter.add(now, v)
+		gauge.add(now, v)
+	}
+
+	// the ring keeps the latest points, oldest first, a counter going back counts nothing
+	fine := counter.fine.since(0)
+	if len(fine) != 3 || fine[0].V != 5 || fine[1].V != 10 || fine[2].V != 0 || fine[2].T != start.Add(5*historyStep).Unix() {
+		t.Fatalf("expected the increases of the last 3 steps, got %v", fine)
+	}
+	if len(counter.fine.since(start.Add(5*historyStep).Unix())) != 1 {
+		t.Fatal("expected only the points at or after the given time")
+	}
+	// counters are summed, gauges averaged
+	if coarse := counter.coarse.since(0); len(coarse) != 1 || coarse[0].V != 20 {
+		t.Fatalf("expected the sum of the increases, got %v", coarse)
+	}
+	if coarse := gauge.coarse.since(0); len(coarse) != 1 || coarse[0].V != 95.0/6 {
+		t.Fatalf("expected the mean of the values, got %v", coarse)
+	}
+}
+
+func TestMetricsHistoryQuery(t *testing.T) {
+	applyConfig(&Config{
+		Pools:  map[string]*PoolConfig{"app": {Servers: []*ServerConfig{{URL: "http://127.0.0.1:1"}}}},
+		Routes: []*RouteConfig{{Prefix: "/", Pool: "app"}},
+	})
+	defer routes.Store(nil)
+	server := currentRoutes().Pools["app"].servers[0]
+
+	h := NewMetricsHistory()
+	now := time.Now()
+	h.Sample(now.Add(-2 * historyStep))
+	server.addConnection(1)
+	server.addConnection(1)
+	h.Sample(now.Add(-historyStep))
+
+	requests, err := h.Query("app", "", "requests", now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.Step != "10s" || len(requests.Points) != 2 || requests.Points[1].V != 2 {
+		t.Fatalf("expected 2 requests in the last step, got %+v", requests)
+	}
+	connections, err := h.Query("app", "http://127.0.0.1:1", "connections", now.Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connections.Step != "1m0s" || len(connections.Points) != 0 {
+		t.Fatalf("expected no 1m points yet, got %+v", connections)
+	}
+	if _, err := h.Query("app", "", "unknown", now.Add(-time.Minute)); err == nil {
+		t.Fatal("expected an error for an unknown metric")
+	}
+
+	for target, status := range map[string]int{
+		"/history": http.StatusOK,
+		"/history?pool=app&metric=requests&since=5m":    http.StatusOK,
+		"/history?pool=app&metric=requests&since=never": http.StatusBadRequest,
+		"/history?pool=web&metric=requests":             http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != status {
+			t.Errorf("%s: expected %d, got %d", target, status, w.Code)
+		}
+	}
+}
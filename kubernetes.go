@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KubernetesIngress string = "ingress"
+	KubernetesGateway string = "gateway"
+
+	GatewayControllerName string = "lbsim.io/gateway-controller"
+
+	annotationMinHealthy        string = "lbsim.io/min-healthy"
+	annotationMinHealthyPercent string = "lbsim.io/min-healthy-percent"
+	serviceAccountDir           string = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// k8sMeta holds the object metadata the controller uses
+type k8sMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Generation  int64             `json:"generation,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// k8sCondition is a status condition of a Gateway API resource
+type k8sCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime"`
+}
+
+// k8sIngress is a networking.k8s.io/v1 Ingress
+type k8sIngress struct {
+	Metadata k8sMeta `json:"metadata"`
+	Spec     struct {
+		IngressClassName string             `json:"ingressClassName"`
+		DefaultBackend   *k8sIngressBackend `json:"defaultBackend"`
+		Rules            []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path     string            `json:"path"`
+					PathType string            `json:"pathType"`
+					Backend  k8sIngressBackend `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+// k8sIngressBackend refers to a port of a Service
+type k8sIngressBackend struct {
+	Service *struct {
+		Name string `json:"name"`
+		Port struct {
+			Name   string `json:"name"`
+			Number int    `json:"number"`
+		} `json:"port"`
+	} `json:"service"`
+}
+
+// k8sGatewayClass is a gateway.networking.k8s.io/v1 GatewayClass
+type k8sGatewayClass struct {
+	Metadata k8sMeta `json:"metadata"`
+	Spec     struct {
+		ControllerName string `json:"controllerName"`
+	} `json:"spec"`
+}
+
+// k8sGateway is a gateway.networking.k8s.io/v1 Gateway
+type k8sGateway struct {
+	Metadata k8sMeta `json:"metadata"`
+	Spec     struct {
+		GatewayClassName string        `json:"gatewayClassName"`
+		Listeners        []k8sListener `json:"listeners"`
+	} `json:"spec"`
+}
+
+// k8sListener is a listener of a Gateway
+type k8sListener struct {
+	Name          string `json:"name"`
+	Hostname      string `json:"hostname"`
+	Port          int    `json:"port"`
+	Protocol      string `json:"protocol"`
+	AllowedRoutes *struct {
+		Namespaces *struct {
+			From     string `json:"from"`
+			Selector *struct {
+				MatchLabels      map[string]string `json:"matchLabels"`
+				MatchExpressions []json.RawMessage `json:"matchExpressions"`
+			} `json:"selector"`
+		} `json:"namespaces"`
+	} `json:"allowedRoutes"`
+}
+
+// from returns where the listener accepts routes from, Same, All or Selector
+func (l k8sListener) from() string {
+	if l.AllowedRoutes == nil || l.AllowedRoutes.Namespaces == nil || l.AllowedRoutes.Namespaces.From == "" {
+		return "Same"
+	}
+	return l.AllowedRoutes.Namespaces.From
+}
+
+// allows reports whether the listener of a Gateway in gwNs accepts routes from ns, namespaces
+// holds the labels of the namespaces for selectors, which only support matchLabels
+func (l k8sListener) allows(ns string, gwNs string, namespaces map[string]map[string]string) bool {
+	switch l.from() {
+	case "All":
+		return true
+	case "Same":
+		return ns == gwNs
+	case "Selector":
+		selector := l.AllowedRoutes.Namespaces.Selector
+		if selector == nil || len(selector.MatchExpressions) > 0 {
+			return false
+		}
+		labels, ok := namespaces[ns]
+		if !ok {
+			return false
+		}
+		for key, value := range selector.MatchLabels {
+			if v, ok := labels[key]; !ok || v != value {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// hosts returns the hostnames of a route the listener accepts, the more specific one of every
+// pair of matching listener and route hostnames, "" standing for any host
+func (l k8sListener) hosts(hostnames []string) []string {
+	if len(hostnames) == 0 {
+		return []string{l.Hostname}
+	}
+	if l.Hostname == "" {
+		return hostnames
+	}
+	var hosts []string
+	for _, h := range hostnames {
+		if matchHost(l.Hostname, h) {
+			hosts = append(hosts, h)
+		} else if matchHost(h, l.Hostname) {
+			hosts = append(hosts, l.Hostname)
+		}
+	}
+	return hosts
+}
+
+// k8sParentRef refers from an HTTPRoute to a Gateway
+type k8sParentRef struct {
+	Group       string `json:"group,omitempty"`
+	Kind        string `json:"kind,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name"`
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// k8sReferenceGrant is a gateway.networking.k8s.io/v1beta1 ReferenceGrant, allowing references
+// from resources in other namespaces to resources in its own
+type k8sReferenceGrant struct {
+	Metadata k8sMeta `json:"metadata"`
+	Spec     struct {
+		From []struct {
+			Group     string `json:"group"`
+			Kind      string `json:"kind"`
+			Namespace string `json:"namespace"`
+		} `json:"from"`
+		To []struct {
+			Group string `json:"group"`
+			Kind  string `json:"kind"`
+			Name  string `json:"name"`
+		} `json:"to"`
+	} `json:"spec"`
+}
+
+// referenceGranted reports whether a grant allows HTTPRoutes in ns to refer to the Service name in refNs
+func referenceGranted(grants []k8sReferenceGrant, ns string, refNs string, name string) bool {
+	for _, grant := range grants {
+		if grant.Metadata.Namespace != refNs {
+			continue
+		}
+		from := false
+		for _, f := range grant.Spec.From {
+			from = from || (f.Group == "gateway.networking.k8s.io" && f.Kind == "HTTPRoute" && f.Namespace == ns)
+		}
+		for _, t := range grant.Spec.To {
+			if from && t.Group == "" && t.Kind == "Service" && (t.Name == "" || t.Name == name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// k8sHTTPRoute is a gateway.networking.k8s.io/v1 HTTPRoute
+type k8sHTTPRoute struct {
+	Metadata k8sMeta `json:"metadata"`
+	Spec     struct {
+		ParentRefs []k8sParentRef `json:"parentRefs"`
+		Hostnames  []string       `json:"hostnames"`
+		Rules      []struct {
+			Matches []struct {
+				Path *struct {
+					Type  string `json:"type"`
+					Value string `json:"value"`
+				} `json:"path"`
+			} `json:"matches"`
+			BackendRefs []struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+				Kind      string `json:"kind"`
+				Port      int    `json:"port"`
+				Weight    *int   `json:"weight"`
+			} `json:"backendRefs"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+// k8sService is a v1 Service
+type k8sService struct {
+	Metadata k8sMeta `json:"metadata"`
+	Spec     struct {
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+// k8sEndpointSlice is a discovery.k8s.io/v1 EndpointSlice
+type k8sEndpointSlice struct {
+	Metadata  k8sMeta `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+// k8sClient talks to the Kubernetes API server
+type k8sClient struct {
+	api       string
+	tokenFile string
+	client    *http.Client
+	watcher   *http.Client
+}
+
+// newK8sClient connects to api, or to the in-cluster API server when api is empty,
+// authenticating with the service account token when one is mounted
+func newK8sClient(api string) (*k8sClient, error) {
+	c := &k8sClient{api: strings.TrimSuffix(api, "/"), tokenFile: serviceAccountDir + "/token"}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, fmt.Errorf("not running in a cluster, the API server URL is required")
+		}
+		c.api = "https://" + net.JoinHostPort(host, port)
+		ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	c.client = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	c.watcher = &http.Client{Transport: transport}
+	return c, nil
+}
+
+func (c *k8sClient) do(client *http.Client, method string, path string, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.api+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token, err := os.ReadFile(c.tokenFile); err == nil {
+		// tokens are rotated, so read them for every request
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// list decodes the items of a list response into out
+func (c *k8sClient) list(path string, out interface{}) error {
+	resp, err := c.do(c.client, http.MethodGet, path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Items json.RawMessage `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+	if len(list.Items) == 0 {
+		return nil
+	}
+	return json.Unmarshal(list.Items, out)
+}
+
+// patchStatus merges status into the status subresource of the object at path
+func (c *k8sClient) patchStatus(path string, status interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(c.client, http.MethodPatch, path+"/status", "application/merge-patch+json", body)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+// watch calls changed for every event on the resources at path until the stream ends
+func (c *k8sClient) watch(path string, changed func()) error {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	resp, err := c.do(c.watcher, http.MethodGet, path+sep+"watch=1&allowWatchBookmarks=false", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &event) == nil && event.Type != "ERROR" {
+			changed()
+		}
+	}
+	return scanner.Err()
+}
+
+// IngressController translates Ingress or Gateway API resources into pools and routes
+type IngressController struct {
+	Mode      string
+	Class     string
+	Namespace string
+	Address   string
+	client    *k8sClient
+	changed   chan struct{}
+	mux       sync.Mutex
+	statuses  map[string]string
+}
+
+// NewIngressController watches Ingresses of the class, or HTTPRoutes attached to
+// Gateways of GatewayClasses naming this controller, in namespace or in all namespaces
+// when it is empty. Address is published in the status of the resources.
+func NewIngressController(mode string, api string, class string, namespace string, address string) (*IngressController, error) {
+	if mode != KubernetesIngress && mode != KubernetesGateway {
+		return nil, fmt.Errorf("unknown Kubernetes mode %q", mode)
+	}
+	client, err := newK8sClient(api)
+	if err != nil {
+		return nil, err
+	}
+	return &IngressController{
+		Mode:      mode,
+		Class:     class,
+		Namespace: namespace,
+		Address:   address,
+		client:    client,
+		changed:   make(chan struct{}, 1),
+		statuses:  map[string]string{},
+	}, nil
+}
+
+// path returns the API path of a namespaced resource collection
+func (k *IngressController) path(group string, resource string) string {
+	prefix := "/apis/" + group
+	if group == "v1" {
+		prefix = "/api/v1"
+	}
+	if k.Namespace != "" {
+		return prefix + "/namespaces/" + k.Namespace + "/" + resource
+	}
+	return prefix + "/" + resource
+}
+
+// Run watches the resources and applies a new config after every change
+func (k *IngressController) Run() {
+	watched := []string{k.path("v1", "services"), k.path("discovery.k8s.io/v1", "endpointslices")}
+	if k.Mode == KubernetesIngress {
+		watched = append(watched, k.path("networking.k8s.io/v1", "ingresses"))
+	} else {
+		watched = append(watched,
+			"/apis/gateway.networking.k8s.io/v1/gatewayclasses",
+			k.path("gateway.networking.k8s.io/v1", "gateways"),
+			k.path("gateway.networking.k8s.io/v1", "httproutes"),
+			k.path("gateway.networking.k8s.io/v1beta1", "referencegrants"))
+	}
+	for _, path := range watched {
+		go func(path string) {
+			for {
+				if err := k.client.watch(path, k.notify); err != nil {
+					log.Println("Kubernetes watch failed, error: ", err)
+				}
+				time.Sleep(5 * time.Second)
+				k.notify()
+			}
+		}(path)
+	}
+
+	for range k.changed {
+		// let bursts of events settle, e.g. endpoint slices of a rolling deployment
+		time.Sleep(time.Second)
+		if err := k.Sync(); err != nil {
+			log.Println("Kubernetes sync failed, keeping last good config, error: ", err)
+		}
+	}
+}
+
+func (k *IngressController) notify() {
+	select {
+	case k.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Sync lists the resources, applies the resulting config and updates their status
+func (k *IngressController) Sync() error {
+	var services []k8sService
+	var slices []k8sEndpointSlice
+	if err := k.client.list(k.path("v1", "services"), &services); err != nil {
+		return err
+	}
+	if err := k.client.list(k.path("discovery.k8s.io/v1", "endpointslices"), &slices); err != nil {
+		return err
+	}
+	b := newK8sConfigBuilder(services, slices)
+	if k.Mode == KubernetesIngress {
+		return k.syncIngresses(b)
+	}
+	return k.syncGateways(b)
+}
+
+// apply applies the config built from the resources, or clears the routes when there are none
+func (k *IngressController) apply(cfg *Config) error {
+	if len(cfg.Routes) == 0 {
+		configMux.Lock()
+		routes.Store(&RouteTable{Pools: map[string]*ServerPool{}})
+		configMux.Unlock()
+		log.Println("Applied config without routes")
+		return nil
+	}
+	return applyConfig(cfg)
+}
+
+func (k *IngressController) syncIngresses(b *k8sConfigBuilder) error {
+	var ingresses []k8sIngress
+	if err := k.client.list(k.path("networking.k8s.io/v1", "ingresses"), &ingresses); err != nil {
+		return err
+	}
+	var owned []k8sIngress
+	for _, ing := range ingresses {
+		class := ing.Spec.IngressClassName
+		if class == "" {
+			class = ing.Metadata.Annotations["kubernetes.io/ingress.class"]
+		}
+		if class != k.Class {
+			continue
+		}
+		owned = append(owned, ing)
+		ns := ing.Metadata.Namespace
+		if backend := ing.Spec.DefaultBackend; backend != nil && backend.Service != nil {
+			b.route("", "/", "Prefix", ns+"/"+ing.Metadata.Name+"/default", []k8sBackend{{ns, backend.Service.Name, backend.Service.Port.Number, backend.Service.Port.Name, 1}})
+		}
+		for _, rule := range ing.Spec.Rules {
+			if rule.HTTP == nil {
+				continue
+			}
+			for _, p := range rule.HTTP.Paths {
+				if p.Backend.Service == nil {
+					continue
+				}
+				path := p.Path
+				if path == "" {
+					path = "/"
+				}
+				svc := p.Backend.Service
+				b.route(rule.Host, path, p.PathType, "", []k8sBackend{{ns, svc.Name, svc.Port.Number, svc.Port.Name, 1}})
+			}
+		}
+	}
+	for _, problems := range b.unresolved {
+		log.Println("Unresolved Ingress backend: ", strings.Join(problems, "; "))
+	}
+	if err := k.apply(b.cfg); err != nil {
+		return err
+	}
+
+	status := map[string]interface{}{"loadBalancer": map[string]interface{}{"ingress": k.addresses()}}
+	for _, ing := range owned {
+		path := "/apis/networking.k8s.io/v1/namespaces/" + ing.Metadata.Namespace + "/ingresses/" + ing.Metadata.Name
+		k.updateStatus(path, status)
+	}
+	return nil
+}
+
+func (k *IngressController) syncGateways(b *k8sConfigBuilder) error {
+	var classes []k8sGatewayClass
+	var gateways []k8sGateway
+	var httpRoutes []k8sHTTPRoute
+	if err := k.client.list("/apis/gateway.networking.k8s.io/v1/gatewayclasses", &classes); err != nil {
+		return err
+	}
+	if err := k.client.list(k.path("gateway.networking.k8s.io/v1", "gateways"), &gateways); err != nil {
+		return err
+	}
+	if err := k.client.list(k.path("gateway.networking.k8s.io/v1", "httproutes"), &httpRoutes); err != nil {
+		return err
+	}
+
+	ownedClasses := map[string]k8sGatewayClass{}
+	for _, class := range classes {
+		if class.Spec.ControllerName == GatewayControllerName {
+			ownedClasses[class.Metadata.Name] = class
+		}
+	}
+	owned := map[string]k8sGateway{}
+	selectors := false
+	for _, gw := range gateways {
+		if _, ok := ownedClasses[gw.Spec.GatewayClassName]; ok {
+			owned[gw.Metadata.Namespace+"/"+gw.Metadata.Name] = gw
+			for _, l := range gw.Spec.Listeners {
+				selectors = selectors || l.from() == "Selector"
+			}
+		}
+	}
+	namespaces := map[string]map[string]string{}
+	if selectors {
+		var list []struct {
+			Metadata k8sMeta `json:"metadata"`
+		}
+		if err := k.client.list("/api/v1/namespaces", &list); err != nil {
+			return err
+		}
+		for _, ns := range list {
+			namespaces[ns.Metadata.Name] = ns.Metadata.Labels
+		}
+	}
+	var grants []k8sReferenceGrant
+	if err := k.client.list(k.path("gateway.networking.k8s.io/v1beta1", "referencegrants"), &grants); err != nil {
+		// without grants, backends in other namespaces are refused
+		log.Println("Listing ReferenceGrants failed, error: ", err)
+	}
+
+	type parentStatus struct {
+		ref    k8sParentRef
+		reason string
+	}
+	type routeStatus struct {
+		route   k8sHTTPRoute
+		parents []parentStatus
+	}
+	var attached []routeStatus
+	for _, hr := range httpRoutes {
+		ns := hr.Metadata.Namespace
+		var parents []parentStatus
+		var hosts []string
+		for _, ref := range hr.Spec.ParentRefs {
+			if ref.Kind != "" && ref.Kind != "Gateway" {
+				continue
+			}
+			refNs := ref.Namespace
+			if refNs == "" {
+				refNs = ns
+			}
+			gw, ok := owned[refNs+"/"+ref.Name]
+			if !ok {
+				continue
+			}
+			// routes attach to the listeners that allow their namespace and share a hostname with them
+			reason := "NotAllowedByListeners"
+			for _, l := range gw.Spec.Listeners {
+				if (ref.SectionName != "" && ref.SectionName != l.Name) || !l.allows(ns, refNs, namespaces) {
+					continue
+				}
+				if reason == "NotAllowedByListeners" {
+					reason = "NoMatchingListenerHostname"
+				}
+				for _, host := range l.hosts(hr.Spec.Hostnames) {
+					reason = ""
+					if !slices.Contains(hosts, host) {
+						hosts = append(hosts, host)
+					}
+				}
+			}
+			parents = append(parents, parentStatus{ref, reason})
+		}
+		if len(parents) == 0 {
+			continue
+		}
+		attached = append(attached, routeStatus{hr, parents})
+		if len(hosts) == 0 {
+			continue
+		}
+
+		for i, rule := range hr.Spec.Rules {
+			name := fmt.Sprintf("%s/%s/rule-%d", ns, hr.Metadata.Name, i)
+			var backends []k8sBackend
+			for _, ref := range rule.BackendRefs {
+				if ref.Kind != "" && ref.Kind != "Service" {
+					b.unresolved[name] = append(b.unresolved[name], fmt.Sprintf("backend %s has unsupported kind %s", ref.Name, ref.Kind))
+					continue
+				}
+				refNs := ref.Namespace
+				if refNs == "" {
+					refNs = ns
+				}
+				if refNs != ns && !referenceGranted(grants, ns, refNs, ref.Name) {
+					b.unresolved[name] = append(b.unresolved[name], fmt.Sprintf("backend %s/%s is not allowed by a ReferenceGrant", refNs, ref.Name))
+					b.refused[name] = true
+					continue
+				}
+				weight := 1
+				if ref.Weight != nil {
+					weight = *ref.Weight
+				}
+				backends = append(backends, k8sBackend{refNs, ref.Name, ref.Port, "", weight})
+			}
+			paths := []string{"/"}
+			types := []string{"PathPrefix"}
+			if len(rule.Matches) > 0 {
+				paths, types = nil, nil
+				for _, m := range rule.Matches {
+					if m.Path == nil || m.Path.Value == "" {
+						paths, types = append(paths, "/"), append(types, "PathPrefix")
+						continue
+					}
+					pathType := m.Path.Type
+					if pathType == "" {
+						pathType = "PathPrefix"
+					}
+					paths, types = append(paths, m.Path.Value), append(types, pathType)
+				}
+			}
+			for _, host := range hosts {
+				for j, path := range paths {
+					b.route(host, path, types[j], name, backends)
+				}
+			}
+		}
+	}
+	if err := k.apply(b.cfg); err != nil {
+		return err
+	}
+
+	for name, class := range ownedClasses {
+		k.updateStatus("/apis/gateway.networking.k8s.io/v1/gatewayclasses/"+name, map[string]interface{}{
+			"conditions": []k8sCondition{k.condition("Accepted", true, "Accepted", "Handled by "+GatewayControllerName, class.Metadata.Generation)},
+		})
+	}
+	for _, gw := range owned {
+		status := map[string]interface{}{
+			"conditions": []k8sCondition{
+				k.condition("Accepted", true, "Accepted", "Gateway accepted", gw.Metadata.Generation),
+				k.condition("Programmed", true, "Programmed", "Listeners are served by the load balancer", gw.Metadata.Generation),
+			},
+		}
+		if addresses := k.gatewayAddresses(); len(addresses) > 0 {
+			status["addresses"] = addresses
+		}
+		k.updateStatus("/apis/gateway.networking.k8s.io/v1/namespaces/"+gw.Metadata.Namespace+"/gateways/"+gw.Metadata.Name, status)
+	}
+	for _, rs := range attached {
+		var problems []string
+		refused := false
+		prefix := rs.route.Metadata.Namespace + "/" + rs.route.Metadata.Name + "/"
+		for name, msgs := range b.unresolved {
+			if strings.HasPrefix(name, prefix) {
+				problems = append(problems, msgs...)
+				refused = refused || b.refused[name]
+			}
+		}
+		sort.Strings(problems)
+		resolved, message := len(problems) == 0, "All references resolved"
+		reason := "ResolvedRefs"
+		if !resolved {
+			message = strings.Join(problems, "; ")
+			reason = "BackendNotFound"
+			if refused {
+				reason = "RefNotPermitted"
+			}
+		}
+		var parents []interface{}
+		for _, ps := range rs.parents {
+			gen := rs.route.Metadata.Generation
+			accepted := k.condition("Accepted", true, "Accepted", "Route accepted", gen)
+			switch ps.reason {
+			case "NotAllowedByListeners":
+				accepted = k.condition("Accepted", false, ps.reason, "No listener of the Gateway allows routes from namespace "+rs.route.Metadata.Namespace, gen)
+			case "NoMatchingListenerHostname":
+				accepted = k.condition("Accepted", false, ps.reason, "No hostname of the route matches a listener of the Gateway", gen)
+			}
+			parents = append(parents, map[string]interface{}{
+				"parentRef":      ps.ref,
+				"controllerName": GatewayControllerName,
+				"conditions": []k8sCondition{
+					accepted,
+					k.condition("ResolvedRefs", resolved, reason, message, gen),
+				},
+			})
+		}
+		k.updateStatus("/apis/gateway.networking.k8s.io/v1/namespaces/"+rs.route.Metadata.Namespace+"/httproutes/"+rs.route.Metadata.Name,
+			map[string]interface{}{"parents": parents})
+	}
+	return nil
+}
+
+// condition returns a status condition, the transition time is filled in by updateStatus
+func (k *IngressController) condition(kind string, ok bool, reason string, message string, generation int64) k8sCondition {
+	status := "False"
+	if ok {
+		status = "True"
+	}
+	return k8sCondition{Type: kind, Status: status, Reason: reason, Message: message, ObservedGeneration: generation}
+}
+
+// updateStatus patches the status of the object at path unless it is unchanged since
+// the last update, as every patch causes another watch event
+func (k *IngressController) updateStatus(path string, status map[string]interface{}) {
+	signature, _ := json.Marshal(status)
+	k.mux.Lock()
+	unchanged := k.statuses[path] == string(signature)
+	k.mux.Unlock()
+	if unchanged {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	var stamp func(v interface{})
+	stamp = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for _, child := range v {
+				stamp(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				stamp(child)
+			}
+		case []k8sCondition:
+			for i := range v {
+				v[i].LastTransitionTime = now
+			}
+		}
+	}
+	stamp(status)
+	if err := k.client.patchStatus(path, status); err != nil {
+		log.Println("Failed to update Kubernetes status, error: ", err)
+		return
+	}
+	k.mux.Lock()
+	k.statuses[path] = string(signature)
+	k.mux.Unlock()
+}
+
+// addresses returns the load balancer address in Ingress status form
+func (k *IngressController) addresses() []map[string]string {
+	if k.Address == "" {
+		return []map[string]string{}
+	}
+	if net.ParseIP(k.Address) != nil {
+		return []map[string]string{{"ip": k.Address}}
+	}
+	return []map[string]string{{"hostname": k.Address}}
+}
+
+// gatewayAddresses returns the load balancer address in Gateway status form
+func (k *IngressController) gatewayAddresses() []map[string]string {
+	if k.Address == "" {
+		return nil
+	}
+	kind := "Hostname"
+	if net.ParseIP(k.Address) != nil {
+		kind = "IPAddress"
+	}
+	return []map[string]string{{"type": kind, "value": k.Address}}
+}
+
+// k8sBackend is a weighted port of a Service
+type k8sBackend struct {
+	namespace string
+	service   string
+	port      int
+	portName  string
+	weight    int
+}
+
+// k8sConfigBuilder resolves backends to ready endpoints and collects pools and routes
+type k8sConfigBuilder struct {
+	services   map[string]k8sService
+	slices     map[string][]k8sEndpointSlice
+	cfg        *Config
+	empty      map[string]bool
+	unresolved map[string][]string
+	refused    map[string]bool
+}
+
+func newK8sConfigBuilder(services []k8sService, slices []k8sEndpointSlice) *k8sConfigBuilder {
+	b := &k8sConfigBuilder{
+		services:   map[string]k8sService{},
+		slices:     map[string][]k8sEndpointSlice{},
+		cfg:        &Config{Pools: map[string]*PoolConfig{}},
+		empty:      map[string]bool{},
+		unresolved: map[string][]string{},
+		refused:    map[string]bool{},
+	}
+	for _, svc := range services {
+		b.services[svc.Metadata.Namespace+"/"+svc.Metadata.Name] = svc
+	}
+	for _, slice := range slices {
+		key := slice.Metadata.Namespace + "/" + slice.Metadata.Labels["kubernetes.io/service-name"]
+		b.slices[key] = append(b.slices[key], slice)
+	}
+	return b
+}
+
+// servers returns the ready endpoints of a backend
+func (b *k8sConfigBuilder) servers(backend k8sBackend) ([]*ServerConfig, error) {
+	key := backend.namespace + "/" + backend.service
+	svc, ok := b.services[key]
+	if !ok {
+		return nil, fmt.Errorf("service %s not found", key)
+	}
+	portName, found := "", false
+	for _, p := range svc.Spec.Ports {
+		if (backend.port != 0 && p.Port == backend.port) || (backend.portName != "" && p.Name == backend.portName) {
+			portName, found = p.Name, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("service %s has no port %d%s", key, backend.port, backend.portName)
+	}
+
+	var servers []*ServerConfig
+	seen := map[string]bool{}
+	for _, slice := range b.slices[key] {
+		port := 0
+		for _, p := range slice.Ports {
+			if p.Name == portName {
+				port = p.Port
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, addr := range ep.Addresses {
+				u := "http://" + net.JoinHostPort(addr, strconv.Itoa(port))
+				if !seen[u] {
+					seen[u] = true
+					servers = append(servers, &ServerConfig{URL: u})
+				}
+			}
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].URL < servers[j].URL
+	})
+	return servers, nil
+}
+
+// route adds a route to a pool of the backends. Routes whose backends have no ready
+// endpoints are left out, so that requests fall through to less specific routes. The
+// path type is Exact, Prefix or PathPrefix, which match whole path elements, or
+// ImplementationSpecific, a plain string prefix.
+func (b *k8sConfigBuilder) route(host string, prefix string, pathType string, name string, backends []k8sBackend) {
+	if name == "" && len(backends) == 1 {
+		be := backends[0]
+		port := be.portName
+		if port == "" {
+			port = strconv.Itoa(be.port)
+		}
+		name = be.namespace + "/" + be.service + ":" + port
+	}
+	if b.empty[name] {
+		return
+	}
+	if _, ok := b.cfg.Pools[name]; !ok {
+		var resolved [][]*ServerConfig
+		var weights []int
+		minimum := &PoolConfig{}
+		for _, be := range backends {
+			if be.weight == 0 {
+				continue
+			}
+			servers, err := b.servers(be)
+			if err != nil {
+				b.unresolved[name] = append(b.unresolved[name], err.Error())
+				continue
+			}
+			if len(servers) > 0 {
+				resolved, weights = append(resolved, servers), append(weights, be.weight)
+				b.minHealthy(minimum, name, be)
+			}
+		}
+		if len(resolved) == 0 {
+			b.empty[name] = true
+			return
+		}
+		pool := &PoolConfig{Servers: splitWeights(resolved, weights), MinHealthy: minimum.MinHealthy, MinHealthyPercent: minimum.MinHealthyPercent}
+		for _, server := range pool.Servers {
+			if server.Weight != pool.Servers[0].Weight {
+				pool.Algorithm = WeightedRoundRobin
+			}
+		}
+		b.cfg.Pools[name] = pool
+	}
+	u, err := url.Parse(prefix)
+	if err != nil || !strings.HasPrefix(u.Path, "/") {
+		return
+	}
+	route := &RouteConfig{Host: host, Prefix: u.Path, Exact: pathType == "Exact", Pool: name}
+	if pathType == "Prefix" || pathType == "PathPrefix" {
+		// a trailing slash is ignored, /foo/ matches /foo as well
+		route.PathPrefix = true
+		if route.Prefix != "/" {
+			route.Prefix = strings.TrimSuffix(route.Prefix, "/")
+		}
+	}
+	b.cfg.Routes = append(b.cfg.Routes, route)
+}
+
+// minHealthy raises the minimum of a pool to the min-healthy annotations of a backend's service
+func (b *k8sConfigBuilder) minHealthy(pool *PoolConfig, name string, backend k8sBackend) {
+	annotations := b.services[backend.namespace+"/"+backend.service].Metadata.Annotations
+	if v, ok := annotations[annotationMinHealthy]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			b.unresolved[name] = append(b.unresolved[name], fmt.Sprintf("invalid %s %q", annotationMinHealthy, v))
+		} else {
+			pool.MinHealthy = max(pool.MinHealthy, n)
+		}
+	}
+	if v, ok := annotations[annotationMinHealthyPercent]; ok {
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(p >= 0 && p <= 100) {
+			b.unresolved[name] = append(b.unresolved[name], fmt.Sprintf("invalid %s %q", annotationMinHealthyPercent, v))
+		} else {
+			pool.MinHealthyPercent = max(pool.MinHealthyPercent, p)
+		}
+	}
+}
+
+// maxWeightScale bounds the common multiple of endpoint counts weights are scaled by
+const maxWeightScale int = 1 << 20
+
+// splitWeights splits the weight of each backend across its endpoints, so that the share
+// of a backend does not grow with its number of endpoints, and returns all endpoints
+func splitWeights(backends [][]*ServerConfig, weights []int) []*ServerConfig {
+	scale := 1
+	for _, servers := range backends {
+		scale = scale / gcd(scale, len(servers)) * len(servers)
+		if scale > maxWeightScale {
+			// rounded shares are close enough with this many endpoints
+			scale = maxWeightScale
+			break
+		}
+	}
+	var all []*ServerConfig
+	common := 0
+	for i, servers := range backends {
+		for _, server := range servers {
+			server.Weight = max(1, (weights[i]*scale+len(servers)/2)/len(servers))
+			common = gcd(common, server.Weight)
+		}
+		all = append(all, servers...)
+	}
+	for _, server := range all {
+		server.Weight /= common
+	}
+	return all
+}
+
+func gcd(a int, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
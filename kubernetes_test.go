@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAPIServer serves lists of resources by path and records status patches
+type fakeAPIServer struct {
+	lists   map[string]string
+	mux     sync.Mutex
+	patches map[string]string
+}
+
+func newFakeAPIServer(t *testing.T, lists map[string]string) (*fakeAPIServer, *httptest.Server) {
+	f := &fakeAPIServer{lists: lists, patches: map[string]string{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		items, ok := f.lists[r.URL.Path]
+		if !ok {
+			items = "[]"
+		}
+		fmt.Fprintf(w, `{"items": %s}`, items)
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			http.Error(w, "unsupported patch", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.mux.Lock()
+		f.patches[r.URL.Path] = string(body)
+		f.mux.Unlock()
+		w.Write(body)
+	default:
+		http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// endpointSlice returns an EndpointSlice of service with n ready endpoints on port 8080
+func endpointSlice(service string, n int) string {
+	var endpoints []string
+	for i := 1; i <= n; i++ {
+		endpoints = append(endpoints, fmt.Sprintf(`{"addresses": ["10.0.%d.%d"], "conditions": {"ready": true}}`, len(service), i))
+	}
+	return fmt.Sprintf(`{"metadata": {"name": "%s-1", "namespace": "default", "labels": {"kubernetes.io/service-name": "%s"}},
+		"endpoints": [%s], "ports": [{"name": "http", "port": 8080}]}`, service, service, strings.Join(endpoints, ","))
+}
+
+func service(name string) string {
+	return fmt.Sprintf(`{"metadata": {"name": "%s", "namespace": "default"}, "spec": {"ports": [{"name": "http", "port": 80}]}}`, name)
+}
+
+func TestIngressController(t *testing.T) {
+	defer routes.Store(nil)
+	fake, api := newFakeAPIServer(t, map[string]string{
+		"/api/v1/services": `[{"metadata": {"name": "web", "namespace": "default", "annotations": {"lbsim.io/min-healthy": "2"}},
+			"spec": {"ports": [{"name": "http", "port": 80}]}}]`,
+		"/apis/discovery.k8s.io/v1/endpointslices": `[` + endpointSlice("web", 2) + `, {"metadata": {"name": "web-2", "namespace": "default",
+			"labels": {"kubernetes.io/service-name": "web"}}, "endpoints": [{"addresses": ["10.0.9.9"], "conditions": {"ready": false}}],
+			"ports": [{"name": "http", "port": 8080}]}]`,
+		"/apis/networking.k8s.io/v1/ingresses": `[{"metadata": {"name": "web", "namespace": "default"}, "spec": {"ingressClassName": "lbsim",
+			"rules": [{"host": "example.com", "http": {"paths": [{"path": "/app/", "pathType": "Prefix",
+			"backend": {"service": {"name": "web", "port": {"number": 80}}}}]}}]}},
+			{"metadata": {"name": "other", "namespace": "default"}, "spec": {"ingressClassName": "nginx"}}]`,
+	})
+	k, err := NewIngressController(KubernetesIngress, api.URL, "lbsim", "", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	table := currentRoutes()
+	if len(table.Routes) != 1 || len(table.Routes[0].Pool.servers) != 2 {
+		t.Fatalf("expected a route to the 2 ready endpoints, got %+v", table.Routes)
+	}
+	if got := table.Routes[0].Pool.MinHealthy(); got != 2 {
+		t.Fatalf("expected the minimum from the service annotation, got %d", got)
+	}
+	for path, match := range map[string]bool{"/app": true, "/app/": true, "/app/x": true, "/apple": false, "/": false} {
+		r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		if got := table.Match(r) != nil; got != match {
+			t.Errorf("%s matched %v, expected %v", path, got, match)
+		}
+	}
+
+	var status struct {
+		Status struct {
+			LoadBalancer struct {
+				Ingress []map[string]string `json:"ingress"`
+			} `json:"loadBalancer"`
+		} `json:"status"`
+	}
+	patch, ok := fake.patches["/apis/networking.k8s.io/v1/namespaces/default/ingresses/web/status"]
+	if !ok || json.Unmarshal([]byte(patch), &status) != nil || status.Status.LoadBalancer.Ingress[0]["ip"] != "192.0.2.1" {
+		t.Fatalf("expected the address in the status, got %q", patch)
+	}
+	if len(fake.patches) != 1 {
+		t.Fatalf("expected only the owned ingress to be updated, got %v", fake.patches)
+	}
+}
+
+func TestGatewayControllerWeights(t *testing.T) {
+	defer routes.Store(nil)
+	fake, api := newFakeAPIServer(t, map[string]string{
+		"/api/v1/services":                                  "[" + service("stable") + "," + service("preview") + "]",
+		"/apis/discovery.k8s.io/v1/endpointslices":          "[" + endpointSlice("stable", 2) + "," + endpointSlice("preview", 10) + "]",
+		"/apis/gateway.networking.k8s.io/v1/gatewayclasses": `[{"metadata": {"name": "lbsim"}, "spec": {"controllerName": "` + GatewayControllerName + `"}}]`,
+		"/apis/gateway.networking.k8s.io/v1/gateways": `[{"metadata": {"name": "gw", "namespace": "default"},
+			"spec": {"gatewayClassName": "lbsim", "listeners": [{"name": "http", "port": 80, "protocol": "HTTP"}]}}]`,
+		"/apis/gateway.networking.k8s.io/v1/httproutes": `[{"metadata": {"name": "split", "namespace": "default"}, "spec": {
+			"parentRefs": [{"name": "gw"}], "rules": [{"backendRefs": [{"name": "stable", "port": 80, "weight": 80}, {"name": "preview", "port": 80, "weight": 20}]}]}}]`,
+	})
+	k, err := NewIngressController(KubernetesGateway, api.URL, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := currentRoutes().Routes[0].Pool
+	if pool.Algorithm != WeightedRoundRobin || len(pool.servers) != 12 {
+		t.Fatalf("expected a weighted pool of 12 servers, got %s with %d", pool.Algorithm, len(pool.servers))
+	}
+	shares := map[string]int{}
+	for _, server := range pool.servers {
+		if strings.HasPrefix(server.URL.Host, "10.0.6.") {
+			shares["stable"] += server.weight
+		} else {
+			shares["preview"] += server.weight
+		}
+	}
+	if shares["stable"]*20 != shares["preview"]*80 {
+		t.Fatalf("expected an 80:20 split, got %v", shares)
+	}
+
+	patch := fake.patches["/apis/gateway.networking.k8s.io/v1/namespaces/default/httproutes/split/status"]
+	if !strings.Contains(patch, `"type":"ResolvedRefs","status":"True"`) {
+		t.Fatalf("expected resolved references in the route status, got %q", patch)
+	}
+}
+
+func TestGatewayControllerNamespaces(t *testing.T) {
+	defer routes.Store(nil)
+	inNamespace := func(resource string, ns string) string {
+		return strings.Replace(resource, `"namespace": "default"`, `"namespace": "`+ns+`"`, 1)
+	}
+	fake, api := newFakeAPIServer(t, map[string]string{
+		"/api/v1/services": "[" + inNamespace(service("shop"), "tenant") + "," + service("web") + "," + service("secret") + "]",
+		"/apis/discovery.k8s.io/v1/endpointslices": "[" + inNamespace(endpointSlice("shop", 2), "tenant") + "," +
+			endpointSlice("web", 1) + "," + endpointSlice("secret", 1) + "]",
+		"/api/v1/namespaces": `[{"metadata": {"name": "tenant", "labels": {"team": "a"}}}, {"metadata": {"name": "guest"}}]`,
+		"/apis/gateway.networking.k8s.io/v1/gatewayclasses": `[{"metadata": {"name": "lbsim"}, "spec": {"controllerName": "` + GatewayControllerName + `"}}]`,
+		"/apis/gateway.networking.k8s.io/v1/gateways": `[{"metadata": {"name": "gw", "namespace": "default"},
+			"spec": {"gatewayClassName": "lbsim", "listeners": [{"name": "http", "port": 80, "protocol": "HTTP"}]}},
+			{"metadata": {"name": "shared", "namespace": "infra"}, "spec": {"gatewayClassName": "lbsim", "listeners": [
+			{"name": "web", "hostname": "*.example.com", "port": 80, "protocol": "HTTP", "allowedRoutes": {"namespaces": {"from": "All"}}},
+			{"name": "team", "hostname": "team.org", "port": 80, "protocol": "HTTP",
+			"allowedRoutes": {"namespaces": {"from": "Selector", "selector": {"matchLabels": {"team": "a"}}}}}]}}]`,
+		"/apis/gateway.networking.k8s.io/v1beta1/referencegrants": `[{"metadata": {"name": "web", "namespace": "default"}, "spec": {
+			"from": [{"group": "gateway.networking.k8s.io", "kind": "HTTPRoute", "namespace": "tenant"}], "to": [{"group": "", "kind": "Service", "name": "web"}]}}]`,
+		"/apis/gateway.networking.k8s.io/v1/httproutes": `[
+			{"metadata": {"name": "steal", "namespace": "tenant"}, "spec": {"parentRefs": [{"name": "gw", "namespace": "default"}],
+			"hostnames": ["shop.example.com"], "rules": [{"backendRefs": [{"name": "shop", "port": 80}]}]}},
+			{"metadata": {"name": "app", "namespace": "tenant"}, "spec": {"parentRefs": [{"name": "shared", "namespace": "infra", "sectionName": "web"}],
+			"hostnames": ["app.example.com", "other.org"], "rules": [
+			{"backendRefs": [{"name": "shop", "port": 80}, {"name": "secret", "namespace": "default", "port": 80}]},
+			{"matches": [{"path": {"value": "/web"}}], "backendRefs": [{"name": "web", "namespace": "default", "port": 80}]}]}},
+			{"metadata": {"name": "wide", "namespace": "tenant"}, "spec": {"parentRefs": [{"name": "shared", "namespace": "infra", "sectionName": "web"}],
+			"hostnames": ["other.org"], "rules": [{"backendRefs": [{"name": "shop", "port": 80}]}]}},
+			{"metadata": {"name": "team", "namespace": "tenant"}, "spec": {"parentRefs": [{"name": "shared", "namespace": "infra", "sectionName": "team"}],
+			"rules": [{"backendRefs": [{"name": "shop", "port": 80}]}]}},
+			{"metadata": {"name": "team", "namespace": "guest"}, "spec": {"parentRefs": [{"name": "shared", "namespace": "infra", "sectionName": "team"}],
+			"rules": [{"matches": [{"path": {"value": "/guest"}}], "backendRefs": [{"name": "shop", "port": 80}]}]}}]`,
+	})
+	k, err := NewIngressController(KubernetesGateway, api.URL, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	table := currentRoutes()
+	for target, servers := range map[string]string{
+		"http://app.example.com/":    "10.0.4.1:8080,10.0.4.2:8080",
+		"http://app.example.com/web": "10.0.3.1:8080",
+		"http://team.org/guest":      "10.0.4.1:8080,10.0.4.2:8080",
+		"http://shop.example.com/":   "",
+		"http://other.org/":          "",
+	} {
+		route := table.Match(httptest.NewRequest("GET", target, nil))
+		var hosts []string
+		if route != nil {
+			for _, server := range route.Pool.servers {
+				hosts = append(hosts, server.URL.Host)
+			}
+		}
+		if strings.Join(hosts, ",") != servers {
+			t.Errorf("%s: expected servers %q, got %v", target, servers, hosts)
+		}
+	}
+
+	for path, expected := range map[string]string{
+		"tenant/httproutes/steal": `"type":"Accepted","status":"False","reason":"NotAllowedByListeners"`,
+		"tenant/httproutes/wide":  `"type":"Accepted","status":"False","reason":"NoMatchingListenerHostname"`,
+		"tenant/httproutes/app":   `"type":"ResolvedRefs","status":"False","reason":"RefNotPermitted"`,
+		"tenant/httproutes/team":  `"type":"Accepted","status":"True"`,
+		"guest/httproutes/team":   `"type":"Accepted","status":"False","reason":"NotAllowedByListeners"`,
+	} {
+		patch := fake.patches["/apis/gateway.networking.k8s.io/v1/namespaces/"+path+"/status"]
+		if !strings.Contains(patch, expected) {
+			t.Errorf("%s: expected %s in the status, got %q", path, expected, patch)
+		}
+	}
+}
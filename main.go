@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"log"
@@ -9,18 +12,30 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"sort"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
-	RoundRobin      string = "RoundRobin"
-	LeastConnection string = "LeastConnection"
-	Attempts        int    = iota
+	RoundRobin         string = "RoundRobin"
+	LeastConnection    string = "LeastConnection"
+	WeightedRoundRobin string = "WeightedRoundRobin"
+	LeastCost          string = "LeastCost"
+	Attempts           int    = iota
 	Retry
+	DecisionKey
+	UsageKey
+	FingerprintKey
+	DeadLetterKey
+	InternalRedirectKey
+	ProbeKey
 )
 
 type Server struct {
@@ -29,6 +44,96 @@ type Server struct {
 	mux          sync.RWMutex
 	ReverseProxy *httputil.ReverseProxy
 	connections  int
+	cost         float64
+	requests     int64
+	failures     int64
+	latency      time.Duration
+	weight       int
+	current      int
+	pool         string
+	draining     bool
+	zone         string
+	labels       map[string]string
+	rtt          time.Duration
+	certExpires  time.Time
+	certError    string
+	egress       *EgressProxy
+	transport    *http.Transport
+
+	// grpcTransport sends the gRPC requests of gRPC-Web clients
+	grpcTransport *http.Transport
+
+	egressFailures int64
+
+	consecutiveFailures int
+	circuitOpenUntil    time.Time
+}
+
+// NewServer creates a server proxying to serverUrl, retrying failed requests before
+// marking the server down and handing the request back to the load balancer
+func NewServer(serverUrl *url.URL, pool string) *Server {
+	server := &Server{
+		URL:    serverUrl,
+		Alive:  true,
+		weight: 1,
+		pool:   pool,
+	}
+	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	server.transport = http.DefaultTransport.(*http.Transport).Clone()
+	server.transport.DialContext = server.dial
+	proxy.Transport = server.transport
+	server.grpcTransport = newGRPCTransport(server.dial)
+	proxy.ModifyResponse = func(*http.Response) error {
+		server.countSuccess()
+		return nil
+	}
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
+		log.Printf("[%s] %s\n", serverUrl.Host, e.Error())
+		// failures of the egress proxy are counted by dial, they are not the backend's
+		egressFailed := isEgressError(e)
+		if !egressFailed {
+			server.countFailure()
+		}
+		decision := GetDecisionFromContext(request)
+		if decision != nil && decision.Error == "" {
+			decision.Error = e.Error()
+		}
+		if overload.Overloaded() {
+			// retries are new work, don't add to it while overloaded
+			log.Printf("%s(%s) Load balancer overloaded, not retrying\n", request.RemoteAddr, request.URL.Path)
+			http.Error(writer, "Load balancer overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		retries := GetRetryFromContext(request)
+		if retries < 3 {
+			select {
+			case <-time.After(10 * time.Millisecond):
+				ctx := context.WithValue(request.Context(), Retry, retries+1)
+				proxy.ServeHTTP(writer, request.WithContext(ctx))
+			}
+			return
+		}
+
+		// after 3 retries, mark this backend as down unless that leaves too few in its pool
+		if egressFailed {
+			log.Printf("[%s] Not ejected, its egress proxy failed\n", serverUrl.Host)
+		} else if err := ejectServer(server); err != nil {
+			log.Printf("[%s] Ejection deferred: %s\n", serverUrl.Host, err)
+		}
+
+		// if the same request routing for few attempts with different backends, increase the count
+		attempts := GetAttemptsFromContext(request)
+		log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
+		if decision != nil {
+			// this attempt failed, the next one is logged as a decision of its own
+			decision.Finish(http.StatusBadGateway)
+		}
+		ctx := context.WithValue(request.Context(), Attempts, attempts+1)
+		ctx = context.WithValue(ctx, DecisionKey, nil)
+		lb(writer, request.WithContext(ctx))
+	}
+	server.ReverseProxy = proxy
+	return server
 }
 
 // SetAlive for this backend
@@ -46,22 +151,131 @@ func (b *Server) IsAlive() (alive bool) {
 	return
 }
 
-func (b *Server) addConnection() {
+// SetDraining takes this backend out of, or puts it back into, rotation without
+// affecting its health
+func (b *Server) SetDraining(draining bool) {
+	b.mux.Lock()
+	b.draining = draining
+	b.mux.Unlock()
+}
+
+// IsDraining returns true when backend is taken out of rotation
+func (b *Server) IsDraining() (draining bool) {
+	b.mux.RLock()
+	draining = b.draining
+	b.mux.RUnlock()
+	return
+}
+
+// InService returns true when backend is alive and not draining
+func (b *Server) InService() (ok bool) {
+	b.mux.RLock()
+	ok = b.Alive && !b.draining
+	b.mux.RUnlock()
+	return
+}
+
+func (b *Server) addConnection(cost float64) {
 	b.mux.Lock()
 	b.connections++
+	b.cost += cost
+	b.requests++
+	b.mux.Unlock()
+}
+
+func (b *Server) countFailure() {
+	b.mux.Lock()
+	b.failures++
+	b.consecutiveFailures++
+	if b.consecutiveFailures >= circuitFailures {
+		b.circuitOpenUntil = time.Now().Add(circuitCooldown)
+	}
 	b.mux.Unlock()
 }
 
-func (b *Server) removeConnection() {
+// Counters returns the number of requests sent to this backend and of failed attempts to proxy them
+func (b *Server) Counters() (requests int64, failures int64) {
+	b.mux.RLock()
+	requests, failures = b.requests, b.failures
+	b.mux.RUnlock()
+	return
+}
+
+func (b *Server) removeConnection(cost float64) {
 	b.mux.Lock()
 	b.connections--
+	b.cost -= cost
+	b.mux.Unlock()
+}
+
+// OutstandingCost returns the summed cost of the requests in flight to this backend
+func (b *Server) OutstandingCost() (cost float64) {
+	b.mux.RLock()
+	cost = b.cost
+	b.mux.RUnlock()
+	return
+}
+
+// Connections returns the number of requests in flight to this backend
+func (b *Server) Connections() (connections int) {
+	b.mux.RLock()
+	connections = b.connections
+	b.mux.RUnlock()
+	return
+}
+
+// recordLatency folds a response time into the smoothed latency estimate
+func (b *Server) recordLatency(d time.Duration) {
+	b.mux.Lock()
+	if b.latency == 0 {
+		b.latency = d
+	} else {
+		b.latency = (b.latency*4 + d) / 5
+	}
 	b.mux.Unlock()
 }
 
+// SetWeight sets the share of requests this backend receives with weighted round robin
+func (b *Server) SetWeight(weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	b.mux.Lock()
+	b.weight = weight
+	b.mux.Unlock()
+}
+
+// Latency returns the smoothed response time of this backend
+func (b *Server) Latency() (latency time.Duration) {
+	b.mux.RLock()
+	latency = b.latency
+	b.mux.RUnlock()
+	return
+}
+
 // ServerPool holds information about reachable servers
 type ServerPool struct {
-	servers []*Server
-	current uint64
+	Name           string
+	Algorithm      string
+	MaxConnections int
+
+	// MinHealthyCount and MinHealthyPercent keep drains, removals and ejections from
+	// leaving too few servers in service
+	MinHealthyCount   int
+	MinHealthyPercent float64
+
+	// Tokens authorizes upstream requests when the pool's backends require bearer tokens
+	Tokens *TokenSource
+
+	servers  []*Server
+	current  uint64
+	mux      sync.Mutex
+	brownout int
+
+	// healthMux makes checks of the minimum and the changes they allow atomic
+	healthMux sync.Mutex
+	ringOnce  sync.Once
+	ring      []hashPoint
 }
 
 // AddBackend to the server pool
@@ -69,6 +283,32 @@ func (s *ServerPool) AddServer(backend *Server) {
 	s.servers = append(s.servers, backend)
 }
 
+// Utilization returns the in-flight requests of the servers in service relative to their
+// capacity, or 0 when the pool has no connection limit
+func (s *ServerPool) Utilization() float64 {
+	if s.MaxConnections <= 0 {
+		return 0
+	}
+	connections, alive := 0, 0
+	for _, server := range s.servers {
+		if server.InService() {
+			connections += server.Connections()
+			alive++
+		}
+	}
+	if alive == 0 {
+		return 1
+	}
+	return float64(connections) / float64(alive*s.MaxConnections)
+}
+
+// BrownoutLevel returns the brownout level last signaled to the backends of the pool
+func (s *ServerPool) BrownoutLevel() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.brownout
+}
+
 // NextIndex atomically increase the counter and return an index
 func (s *ServerPool) NextIndex() int {
 	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.servers)))
@@ -84,68 +324,85 @@ func (s *ServerPool) MarkServerStatus(backendUrl *url.URL, alive bool) {
 	}
 }
 
-// GetNextServerRoundRobin returns next active server to take a connection in round robin fashion
-func (s *ServerPool) GetNextServerRoundRobin() *Server {
-	next := s.NextIndex()
-	l := len(s.servers) + next
-	for i := next; i < l; i++ {
-		idx := i % len(s.servers)
-		if s.servers[idx].IsAlive() {
-			if i != next {
-				atomic.StoreUint64(&s.current, uint64(idx))
-			}
-			return s.servers[idx]
-		}
+// GetNextServer returns the next server in service using the algorithm of the pool
+func (s *ServerPool) GetNextServer() *Server {
+	switch s.Algorithm {
+	case LeastConnection:
+		return s.GetNextServerLeastConnection()
+	case WeightedRoundRobin:
+		return s.GetNextServerWeightedRoundRobin()
+	case LeastCost:
+		return s.GetNextServerLeastCost()
+	default:
+		return s.GetNextServerRoundRobin()
 	}
-	return nil
 }
 
-// GetNextServerLeastConnection returns next active server with least active connection
-func (s *ServerPool) GetNextServerLeastConnection() *Server {
-	sort.Slice(s.servers, func(i, j int) bool {
-		return s.servers[i].connections < s.servers[j].connections
-	})
-	for idx, server := range s.servers {
-		if server.IsAlive() {
-			return s.servers[idx]
-		}
+// isServerAlive checks whether a server is Alive by establishing a TCP connection,
+// returning the round trip time of the TCP handshake or why the server is not alive
+func isServerAlive(b *Server) (time.Duration, error) {
+	if b.URL.Scheme == "mqtt" {
+		return isBrokerAlive(b)
 	}
-	return nil
-}
-
-// isServerAlive checks whether a server is Alive by establishing a TCP connection
-func isServerAlive(u *url.URL) bool {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+	conn, rtt, err := b.connectTimed(2 * time.Second)
 	if err != nil {
-		log.Println("Site unreachable, error: ", err)
-		return false
+		return 0, err
 	}
 	defer conn.Close()
-	return true
+	return rtt, nil
 }
 
-// HealthCheck pings the server and updates the statuses
+// HealthCheck pings the servers of the pool and updates their statuses
 func (s *ServerPool) HealthCheck() {
 	for _, b := range s.servers {
-		status := "up"
-		alive := isServerAlive(b.URL)
-		b.SetAlive(alive)
-		if !alive {
-			status = "down"
-		}
-		log.Printf("%s [%s]\n", b.URL, status)
+		b.HealthCheck()
+	}
+}
+
+// HealthCheck pings the server and updates its status
+func (b *Server) HealthCheck() {
+	status := "up"
+	rtt, err := isServerAlive(b)
+	if isEgressError(err) {
+		// a failing egress proxy says nothing about the backend, its state is kept
+		log.Printf("%s [unchanged] Egress proxy failed, error: %s\n", redactURL(b.URL), err)
+		return
+	}
+	if err != nil {
+		log.Println("Site unreachable, error: ", err)
+	}
+	alive := err == nil
+	if alive && b.URL.Scheme == "https" && certMonitor != nil {
+		alive = certMonitor.Check(b)
+	}
+	b.SetAlive(alive)
+	if !alive {
+		status = "down"
+		b.resetRTT()
+	} else if b.Egress() == nil {
+		// through a proxy the handshake is the proxy's, which says nothing about distance
+		b.recordRTT(rtt)
 	}
+	log.Printf("%s [%s] rtt %s\n", redactURL(b.URL), status, b.RTT())
 }
 
+// addedServers receives the servers config updates add, they are checked right away
+// instead of waiting for the next round, so that their RTT is known. When health checks
+// fall behind, added servers are left to the next round.
+var addedServers = make(chan []*Server, 16)
+
 func healthCheck() {
 	t := time.NewTicker(time.Minute * 2)
 	for {
 		select {
 		case <-t.C:
 			log.Println("Starting health check...")
-			serverPool.HealthCheck()
+			currentRoutes().HealthCheck()
 			log.Println("Health check completed")
+		case servers := <-addedServers:
+			for _, b := range servers {
+				b.HealthCheck()
+			}
 		}
 	}
 }
@@ -171,94 +428,453 @@ func lb(w http.ResponseWriter, r *http.Request) {
 	attempts := GetAttemptsFromContext(r)
 	if attempts > 3 {
 		log.Printf("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
+		if deadLetters != nil {
+			deadLetters.Capture(r)
+		}
 		http.Error(w, "Service not available", http.StatusServiceUnavailable)
 		return
 	}
 
-	var peer *Server
+	route := currentRoutes().Match(r)
+	if route == nil {
+		http.Error(w, "No route for request", http.StatusNotFound)
+		return
+	}
+	pool := route.Pool
+	if route.GRPCWeb && isGRPCWebPreflight(r) {
+		serveGRPCWebPreflight(w, r, route.GRPCWebOrigins)
+		return
+	}
+	if route.Validator != nil && attempts == 1 && GetInternalRedirectsFromContext(r) == 0 {
+		if !route.Validator.Check(w, r) {
+			return
+		}
+	}
+	if route.Static != nil {
+		route.Static.ServeHTTP(w, r)
+		return
+	}
+	release := func() {}
+	if route.Bulkhead != nil && attempts == 1 {
+		// later attempts are made within the first one and share its slot
+		if !route.Bulkhead.Acquire(r.Context()) {
+			log.Printf("%s(%s) Route %s%s at its concurrency limit, rejecting\n", r.RemoteAddr, r.URL.Path, route.Host, route.Prefix)
+			http.Error(w, "Service not available", http.StatusServiceUnavailable)
+			return
+		}
+		released := false
+		release = func() {
+			if !released {
+				released = true
+				route.Bulkhead.Release()
+			}
+		}
+		defer release()
+	}
 
-	switch algorithm {
-	case LeastConnection:
-		peer = serverPool.GetNextServerLeastConnection()
-	default:
-		peer = serverPool.GetNextServerRoundRobin()
+	var decision *Decision
+	if decisionLog != nil && !IsProbe(r) && decisionLog.Sample() {
+		decision = NewDecision(r, attempts, pool)
+		if route.Pipeline.Algorithm != "" {
+			decision.Algorithm = route.Pipeline.Algorithm
+		}
+	}
+
+	var clientHeader http.Header
+	if route.InternalRedirect != "" && attempts == 1 {
+		// redirected requests are sent with the client's headers, not those added for the pool
+		clientHeader = r.Header.Clone()
+	}
+
+	// the level is only ever set by the load balancer, clients must not fake it
+	r.Header.Del(brownoutHeader)
+	if brownout != nil {
+		r.Header.Set(brownoutHeader, strconv.Itoa(brownout.Level(pool)))
 	}
 
-	peer.addConnection()
+	if pool.Tokens != nil && attempts == 1 {
+		if err := pool.Tokens.Authorize(r); err != nil {
+			log.Printf("%s(%s) Failed to obtain token for pool %s, error: %s\n", r.RemoteAddr, r.URL.Path, pool.Name, err)
+			http.Error(w, "Bad gateway", http.StatusBadGateway)
+			return
+		}
+	}
+
+	peer, err := route.Pipeline.Select(pool)
 	if peer != nil {
-		peer.ReverseProxy.ServeHTTP(w, r)
-		peer.removeConnection()
+		if buffering != nil && buffering.Responses && attempts == 1 && GetInternalRedirectsFromContext(r) == 0 {
+			// later attempts and internal redirects write to the same buffer, it is sent once
+			// the first attempt returns
+			buffered := buffering.Wrap(w)
+			w = buffered
+			defer func() {
+				// the backend is done, a slow client reading the response does not hold the slot
+				release()
+				buffered.Finish()
+			}()
+		}
+		var redirect *internalRedirectWriter
+		out := w
+		if clientHeader != nil {
+			redirect = newInternalRedirectWriter(w, route.InternalRedirect)
+			w = redirect
+		}
+		if decision != nil {
+			decision.Chosen = redactURL(peer.URL)
+			rec := &responseRecorder{ResponseWriter: w}
+			w, r = rec, r.WithContext(context.WithValue(r.Context(), DecisionKey, decision))
+			defer func() {
+				decision.Finish(rec.status)
+				decisionLog.Log(decision)
+			}()
+		}
+		cost := route.Cost.Estimate(r)
+		if route.Cost.Header != "" {
+			w = &costWriter{ResponseWriter: w, cost: route.Cost, r: r}
+		}
+		peer.addConnection(cost)
+		start := time.Now()
+		if route.GRPCWeb && isGRPCWeb(r) {
+			serveGRPCWeb(w, r, peer, route.GRPCWebOrigins)
+		} else {
+			peer.ReverseProxy.ServeHTTP(w, r)
+		}
+		elapsed := time.Since(start)
+		peer.recordLatency(elapsed)
+		if usage := GetUsageFromContext(r); usage != nil && attempts == 1 {
+			// retries are served within the first attempt, so it covers all backend time
+			usage.backend.Add(int64(elapsed))
+		}
+		peer.removeConnection(cost)
+		if redirect != nil && redirect.location != "" {
+			serveInternalRedirect(out, r, clientHeader, redirect)
+		}
 		return
 	}
-	peer.removeConnection()
+	log.Printf("%s(%s) %s\n", r.RemoteAddr, r.URL.Path, err)
+	if decision != nil {
+		decision.Error = err.Error()
+		decision.Finish(http.StatusServiceUnavailable)
+		decisionLog.Log(decision)
+	}
+	if deadLetters != nil {
+		deadLetters.Capture(r)
+	}
 	http.Error(w, "Service not available", http.StatusServiceUnavailable)
 }
 
-var serverPool ServerPool
 var algorithm string
+var zone string
+var decisionLog *DecisionLogger
+var buffering *Buffering
+var brownout *Brownout
+var deadLetters *DeadLetters
+var certMonitor *CertMonitor
+var prober *Prober
+var overload *OverloadGuard
 
 func main() {
-	var serverList string
-	var port int
+	if len(os.Args) > 1 && os.Args[1] == "deadletters" {
+		runDeadLetterCommand(os.Args[2:])
+		return
+	}
+
+	var serverList, configFile, configKV, configCache string
+	var k8sMode, k8sAPI, k8sClass, k8sNamespace, k8sAddress string
+	var port, adminPort int
+	var adminAddress, adminTokenFile string
+	var maxInFlight int64
+	var maxGoroutines, maxHeapMB int
+	var bufferRequests, bufferResponses bool
+	var bufferMemory, bufferLimit int64
+	var bufferDir string
+	var brownoutThresholds string
+	var brownoutHysteresis float64
+	var mqttPort int
+	var mqttPool string
+	var socksPort, socksMaxPerUser int
+	var socksPool, socksUsers, socksAllow string
+	var deadLetterDir string
+	var deadLetterMaxBody int64
+	var certWarnDays, certCA string
+	var certEnforce bool
+	var probesFile string
+	var openAPIFiles, openAPIMode string
+	var decisionLogPath, decisionLogFormat string
+	var decisionSample float64
+	var meterSources, meterDir, meterFormat, meterWebhook, meterKey string
+	var meterInterval time.Duration
+	var meterMaxConsumers int
+	var tlsCert, tlsKey, tlsClientCA, fingerprintDeny string
+	var fingerprintRate float64
+	var fingerprintLog bool
 	flag.StringVar(&serverList, "servers", "", "Load balanced backends, use commas to separate")
 	flag.IntVar(&port, "port", 3030, "Port to serve")
 	flag.StringVar(&algorithm, "algorithm", "", "Load balancing Algorithm")
+	flag.StringVar(&zone, "zone", "", "Zone the load balancer runs in, for the same_zone filter of routes")
+	flag.IntVar(&adminPort, "admin-port", 0, "Port to serve the admin API on, 0 to disable it")
+	flag.StringVar(&adminAddress, "admin-address", "127.0.0.1", "Address to serve the admin API on")
+	flag.StringVar(&adminTokenFile, "admin-token", "", "File holding the token admin API clients have to present, required on addresses other than loopback")
+	flag.Int64Var(&maxInFlight, "max-inflight", 0, "Maximum in-flight requests before new requests are rejected, 0 for no limit")
+	flag.IntVar(&maxGoroutines, "max-goroutines", 0, "Maximum goroutines before new requests are rejected, 0 for no limit")
+	flag.IntVar(&maxHeapMB, "max-heap-mb", 0, "Maximum heap size in MB before new requests are rejected, 0 for no limit")
+	flag.StringVar(&configFile, "config", "", "JSON file with pools and routes")
+	flag.StringVar(&configKV, "config-kv", "", "Consul-compatible KV key URL to watch for pools and routes")
+	flag.StringVar(&configCache, "config-cache", "", "File to keep the last good config from the KV store in")
+	flag.StringVar(&k8sMode, "k8s", "", "Run as Kubernetes controller for either ingress or gateway resources")
+	flag.StringVar(&k8sAPI, "k8s-api", "", "Kubernetes API server URL, defaults to the in-cluster API server")
+	flag.StringVar(&k8sClass, "k8s-class", "lbsim", "Ingress class to handle")
+	flag.StringVar(&k8sNamespace, "k8s-namespace", "", "Namespace to watch, defaults to all namespaces")
+	flag.StringVar(&k8sAddress, "k8s-address", "", "Address of the load balancer published in resource status")
+	flag.BoolVar(&bufferRequests, "buffer-requests", false, "Read request bodies completely before proxying them")
+	flag.BoolVar(&bufferResponses, "buffer-responses", false, "Read responses completely before sending them to clients")
+	flag.Int64Var(&bufferMemory, "buffer-memory", 1<<20, "Bytes of a buffered body to keep in memory before spilling to a file")
+	flag.Int64Var(&bufferLimit, "buffer-limit", 100<<20, "Maximum bytes of a buffered body")
+	flag.StringVar(&bufferDir, "buffer-dir", "", "Directory for buffer files, defaults to the temporary directory")
+	flag.StringVar(&brownoutThresholds, "brownout", "", "Pool utilizations at which the brownout level rises, use commas to separate")
+	flag.Float64Var(&brownoutHysteresis, "brownout-hysteresis", 0.05, "How far utilization has to drop below a threshold to lower the brownout level")
+	flag.StringVar(&brownoutHeader, "brownout-header", brownoutHeader, "Request header passing the brownout level to backends")
+	flag.IntVar(&mqttPort, "mqtt-port", 0, "Port to proxy MQTT clients on, 0 to disable it")
+	flag.StringVar(&mqttPool, "mqtt-pool", "default", "Pool of MQTT brokers")
+	flag.StringVar(&deadLetterDir, "dead-letter-dir", "", "Directory to capture requests that exhausted all attempts to")
+	flag.Int64Var(&grpcWebMaxBody, "grpc-web-max-body", 4<<20, "Maximum bytes of a gRPC-Web request body")
+	flag.Int64Var(&deadLetterMaxBody, "dead-letter-max-body", 1<<20, "Maximum bytes of a request body to capture")
+	flag.StringVar(&certWarnDays, "cert-warn-days", "30,14,7,1", "Days before the certificate of an https backend expires to warn at, use commas to separate")
+	flag.BoolVar(&certEnforce, "cert-enforce", false, "Mark https backends down once their certificate expired or fails verification")
+	flag.StringVar(&certCA, "cert-ca", "", "PEM file with CA certificates to verify https backends against, besides the system roots")
+	flag.StringVar(&probesFile, "probes", "", "JSON file with synthetic requests to send through the load balancer")
+	flag.IntVar(&socksPort, "socks-port", 0, "Port to serve SOCKS5 clients on, 0 to disable the SOCKS5 proxy")
+	flag.StringVar(&socksPool, "socks-pool", "default", "Pool of egress gateways to send SOCKS5 connections through")
+	flag.StringVar(&socksUsers, "socks-users", "", "File with a user:password per line to authenticate SOCKS5 clients with")
+	flag.StringVar(&socksAllow, "socks-allow", "", "Destinations SOCKS5 clients may connect to, e.g. *.example.com:443,10.0.0.0/8, use commas to separate")
+	flag.IntVar(&socksMaxPerUser, "socks-max-per-user", 0, "Maximum SOCKS5 connections per user, or per client address without authentication, 0 for no limit")
+	flag.StringVar(&openAPIFiles, "openapi", "", "OpenAPI 3 JSON documents to validate requests against, use commas to separate")
+	flag.StringVar(&openAPIMode, "openapi-mode", ValidationEnforce, "Validation mode, either enforce or report")
+	flag.Int64Var(&openAPIMaxBody, "openapi-max-body", 1<<20, "Maximum bytes of a request body to validate, larger bodies are passed on unchecked")
+	flag.StringVar(&decisionLogPath, "decision-log", "", "File to log balancing decisions to")
+	flag.StringVar(&decisionLogFormat, "decision-log-format", FormatNDJSON, "Decision log format, either ndjson or csv")
+	flag.Float64Var(&decisionSample, "decision-sample", 1, "Fraction of balancing decisions to log")
+	flag.StringVar(&meterSources, "meter-consumer", "", "Consumer identity sources for usage metering (header:<Name>, cert, ja3 or ja4), use commas to separate")
+	flag.DurationVar(&meterInterval, "meter-interval", time.Minute, "Usage aggregation interval")
+	flag.StringVar(&meterDir, "meter-dir", "", "Directory to write daily usage files to")
+	flag.StringVar(&meterFormat, "meter-format", FormatCSV, "Usage file format, either csv or ndjson")
+	flag.StringVar(&meterWebhook, "meter-webhook", "", "URL to post usage records to")
+	flag.IntVar(&meterMaxConsumers, "meter-max-consumers", 10000, "Maximum consumers recorded per interval, further ones are accounted to other")
+	flag.StringVar(&meterKey, "meter-key", "", "File holding the key header consumer identities are hashed with, a random key when empty")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate file to serve HTTPS with")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key file to serve HTTPS with")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA certificates file to verify the certificates of HTTPS clients with")
+	flag.StringVar(&fingerprintDeny, "fingerprint-deny", "", "JA3 hashes or JA4 fingerprints to reject, use commas to separate")
+	flag.Float64Var(&fingerprintRate, "fingerprint-rate", 0, "Requests per second allowed per JA4 fingerprint, 0 for no limit")
+	flag.BoolVar(&fingerprintLog, "fingerprint-log", false, "Log the TLS fingerprints of every request")
 	flag.Parse()
-
-	if len(serverList) == 0 {
-		log.Fatal("Please provide one or more backends to load balance")
+	if socksPort != 0 {
+		socksGatewayPool = socksPool
 	}
 
-	// parse servers
-	tokens := strings.Split(serverList, ",")
-	for _, tok := range tokens {
-		serverUrl, err := url.Parse(tok)
+	var cfg *Config
+	var err error
+	var watcher *KVWatcher
+	var controller *IngressController
+	applied := false
+	if brownoutThresholds != "" {
+		// before the first config is applied, which checks pools can brown out
+		brownout, err = NewBrownout(brownoutThresholds, brownoutHysteresis)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		proxy := httputil.NewSingleHostReverseProxy(serverUrl)
-		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
-			log.Printf("[%s] %s\n", serverUrl.Host, e.Error())
-			retries := GetRetryFromContext(request)
-			if retries < 3 {
-				select {
-				case <-time.After(10 * time.Millisecond):
-					ctx := context.WithValue(request.Context(), Retry, retries+1)
-					proxy.ServeHTTP(writer, request.WithContext(ctx))
-				}
-				return
+	}
+	switch {
+	case k8sMode != "":
+		controller, err = NewIngressController(k8sMode, k8sAPI, k8sClass, k8sNamespace, k8sAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := controller.Sync(); err != nil {
+			log.Println("Kubernetes sync failed, starting without routes, error: ", err)
+			controller.apply(&Config{})
+		}
+		go controller.Run()
+	case configFile != "":
+		cfg, err = LoadConfig(configFile)
+	case len(serverList) != 0:
+		cfg = StaticConfig(serverList)
+	}
+	if configKV != "" && controller == nil {
+		// the store takes precedence, the cache and static servers are only a fallback
+		watcher = NewKVWatcher(configKV, configCache)
+		applied = watcher.Bootstrap()
+	}
+	if !applied {
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cfg == nil && controller == nil {
+			log.Fatal("Please provide one or more backends to load balance")
+		}
+		if cfg != nil {
+			if err := applyConfig(cfg); err != nil {
+				log.Fatal(err)
 			}
+		}
+	}
+	if watcher != nil {
+		go watcher.Run()
+	}
 
-			// after 3 retries, mark this backend as down
-			serverPool.MarkServerStatus(serverUrl, false)
+	certMonitor, err = NewCertMonitor(certWarnDays, certEnforce, certCA)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-			// if the same request routing for few attempts with different backends, increase the count
-			attempts := GetAttemptsFromContext(request)
-			log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
-			ctx := context.WithValue(request.Context(), Attempts, attempts+1)
-			lb(writer, request.WithContext(ctx))
+	if decisionLogPath != "" {
+		decisionLog, err = NewDecisionLogger(decisionLogPath, decisionLogFormat, decisionSample)
+		if err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		serverPool.AddServer(&Server{
-			URL:          serverUrl,
-			Alive:        true,
-			ReverseProxy: proxy,
-		})
-		log.Printf("Configured server: %s\n", serverUrl)
+	handler := http.Handler(http.HandlerFunc(lb))
+	if deadLetterDir != "" {
+		deadLetters, err = NewDeadLetters(deadLetterDir, deadLetterMaxBody)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = deadLetters.Middleware(handler)
+	}
+	if bufferRequests || bufferResponses {
+		buffering = &Buffering{Requests: bufferRequests, Responses: bufferResponses, Memory: bufferMemory, Limit: bufferLimit, Dir: bufferDir}
+		handler = buffering.Middleware(handler)
+	}
+	if openAPIFiles != "" {
+		validator, err := NewRequestValidator(openAPIFiles, openAPIMode)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = validator.Middleware(handler)
+	}
+	handler = NewFingerprintPolicy(fingerprintDeny, fingerprintRate, fingerprintLog).Middleware(handler)
+	if meterSources != "" {
+		if slices.Contains(strings.Split(meterSources, ","), "cert") && tlsClientCA == "" {
+			log.Fatal("The cert consumer source requires client certificates, see tls-client-ca")
+		}
+		var key []byte
+		if meterKey != "" {
+			if key, err = os.ReadFile(meterKey); err != nil {
+				log.Fatal(err)
+			}
+		} else if strings.Contains(meterSources, "header:") {
+			log.Println("WARNING no meter-key, header consumer identities change when the load balancer restarts")
+		}
+		meter, err := NewMeter(meterSources, meterInterval, meterDir, meterFormat, meterWebhook, meterMaxConsumers, bytes.TrimSpace(key))
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = meter.Middleware(handler)
+		go meter.Run()
+		go func() {
+			// export the usage of the last interval on shutdown
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			<-sig
+			meter.Export()
+			os.Exit(0)
+		}()
+	}
+	if probesFile != "" {
+		scheme := "http"
+		if tlsCert != "" {
+			scheme = "https"
+		}
+		prober, err = NewProber(probesFile, fmt.Sprintf("%s://127.0.0.1:%d", scheme, port))
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = prober.Middleware(handler)
 	}
+	// the guard goes first, so that no work is done for rejected requests
+	overload = NewOverloadGuard(maxInFlight, maxGoroutines, uint64(maxHeapMB)<<20)
+	handler = overload.Middleware(handler)
+	adminMux.Handle("/overload", overload)
+	go overload.Run()
 
 	// create http server
 	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: http.HandlerFunc(lb),
+		Addr:        fmt.Sprintf(":%d", port),
+		Handler:     handler,
+		ConnContext: fingerprintConnContext,
+	}
+	if tlsClientCA != "" {
+		data, err := os.ReadFile(tlsClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			log.Fatalf("No certificates found in %s", tlsClientCA)
+		}
+		server.TLSConfig = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
 	}
 
 	// start health checking
 	go healthCheck()
 
+	if mqttPort != 0 {
+		go (&MQTTProxy{Pool: mqttPool}).Serve(mqttPort)
+	}
+
+	if socksPort != 0 {
+		socks, err := NewSOCKSProxy(socksPool, socksUsers, socksAllow, socksMaxPerUser)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go socks.Serve(socksPort)
+	}
+
+	if adminPort != 0 {
+		var token string
+		if adminTokenFile != "" {
+			data, err := os.ReadFile(adminTokenFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if token = strings.TrimSpace(string(data)); token == "" {
+				log.Fatal("The admin token file is empty")
+			}
+		} else if !isLoopback(adminAddress) {
+			log.Fatal("The admin API changes the routing and shows the config, serving it on other addresses than loopback requires admin-token")
+		}
+		history := NewMetricsHistory()
+		adminMux.Handle("/history", history)
+		adminMux.HandleFunc("/routes", serveRoutes)
+		adminMux.HandleFunc("/servers", serveServers)
+		adminMux.HandleFunc("/servers/drain", serveDrain)
+		adminMux.HandleFunc("/playground", servePlayground)
+		adminMux.HandleFunc("/playground/replay", servePlaygroundReplay)
+		if prober != nil {
+			adminMux.Handle("/probes", prober)
+		}
+		go history.Run()
+		go serveAdmin(adminAddress, adminPort, token)
+	}
+
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if prober != nil {
+		// the listener is bound, so the first runs of the probes reach it
+		go prober.Run()
+	}
+
 	log.Printf("Load Balancer started at :%d\n", port)
-	if err := server.ListenAndServe(); err != nil {
+	if tlsCert != "" {
+		if err := server.ServeTLS(fingerprintListener{ln}, tlsCert, tlsKey); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := server.Serve(ln); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	anonymousConsumer string = "anonymous"
+	overflowConsumer  string = "other"
+)
+
+// UsageRecord aggregates the usage of a single consumer over one interval
+type UsageRecord struct {
+	Consumer  string    `json:"consumer"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Requests  int64     `json:"requests"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	BackendMs float64   `json:"backend_ms"`
+}
+
+// usageSample collects the usage of a single request while it is being served
+type usageSample struct {
+	bytesIn atomic.Int64
+	backend atomic.Int64
+}
+
+// Meter records per-consumer usage and exports it every interval
+type Meter struct {
+	mux      sync.Mutex
+	sources  []string
+	records  map[string]*UsageRecord
+	start    time.Time
+	dir      string
+	format   string
+	webhook  string
+	interval time.Duration
+
+	// key hashes the header values consumers are identified by, header values are often
+	// credentials and must not reach the usage exports
+	key []byte
+
+	// MaxConsumers caps the consumers recorded per interval, the usage of further
+	// consumers is accounted to "other"
+	MaxConsumers int
+
+	// pending holds the records the webhook failed to receive, to be posted again
+	pending []*UsageRecord
+	postMux sync.Mutex
+}
+
+// NewMeter identifies consumers by the first non-empty of the comma separated sources,
+// each either header:<Name>, cert, ja3 or ja4, recording at most maxConsumers per interval.
+// Header values are exported as their HMAC-SHA256 under key, a random key when it is empty.
+func NewMeter(sources string, interval time.Duration, dir string, format string, webhook string, maxConsumers int, key []byte) (*Meter, error) {
+	m := &Meter{
+		records:      map[string]*UsageRecord{},
+		start:        time.Now(),
+		dir:          dir,
+		format:       format,
+		webhook:      webhook,
+		interval:     interval,
+		key:          key,
+		MaxConsumers: maxConsumers,
+	}
+	if len(m.key) == 0 {
+		m.key = make([]byte, 32)
+		rand.Read(m.key)
+	}
+	for _, source := range strings.Split(sources, ",") {
+		if source != "cert" && source != "ja3" && source != "ja4" && !strings.HasPrefix(source, "header:") {
+			return nil, fmt.Errorf("unknown consumer source %q", source)
+		}
+		m.sources = append(m.sources, source)
+	}
+	if format != FormatNDJSON && format != FormatCSV {
+		return nil, fmt.Errorf("unknown usage export format %q", format)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("metering interval must be positive")
+	}
+	if maxConsumers <= 0 {
+		return nil, fmt.Errorf("maximum number of consumers must be positive")
+	}
+	if dir == "" && webhook == "" {
+		return nil, fmt.Errorf("usage metering needs a directory or a webhook to export to")
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Consumer returns the identity the request is accounted to
+func (m *Meter) Consumer(r *http.Request) string {
+	for _, source := range m.sources {
+		switch source {
+		case "cert":
+			if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+				return "cert:" + r.TLS.PeerCertificates[0].Subject.CommonName
+			}
+			continue
+		case "ja3":
+			if fp := GetFingerprintFromContext(r); fp != nil {
+				return "ja3:" + fp.JA3Hash
+			}
+			continue
+		case "ja4":
+			if fp := GetFingerprintFromContext(r); fp != nil {
+				return "ja4:" + fp.JA4
+			}
+			continue
+		}
+		name := strings.TrimPrefix(source, "header:")
+		if value := r.Header.Get(name); value != "" {
+			return name + ":" + m.hash(value)
+		}
+	}
+	return anonymousConsumer
+}
+
+// hash returns the first 128 bits of the HMAC of a header value, in hex
+func (m *Meter) hash(value string) string {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Middleware accounts every request to its consumer, except those of synthetic probes
+func (m *Meter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsProbe(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		consumer := m.Consumer(r)
+		sample := &usageSample{}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countingReader{ReadCloser: r.Body, n: &sample.bytesIn}
+		}
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), UsageKey, sample)))
+		m.add(consumer, sample, rec.bytes)
+	})
+}
+
+func (m *Meter) add(consumer string, sample *usageSample, bytesOut int64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	record, ok := m.records[consumer]
+	if !ok && len(m.records) >= m.MaxConsumers {
+		if _, seen := m.records[overflowConsumer]; !seen {
+			log.Printf("WARNING more than %d consumers this interval, accounting further ones to %s\n", m.MaxConsumers, overflowConsumer)
+		}
+		consumer = overflowConsumer
+		record, ok = m.records[consumer]
+	}
+	if !ok {
+		record = &UsageRecord{Consumer: consumer}
+		m.records[consumer] = record
+	}
+	record.Requests++
+	record.BytesIn += sample.bytesIn.Load()
+	record.BytesOut += bytesOut
+	record.BackendMs += milliseconds(time.Duration(sample.backend.Load()))
+}
+
+// Run exports the aggregated usage every interval, Export has to be called once more
+// on shutdown for the last one
+func (m *Meter) Run() {
+	t := time.NewTicker(m.interval)
+	for {
+		select {
+		case <-t.C:
+			m.Export()
+		}
+	}
+}
+
+// Export writes out and resets the usage of the current interval
+func (m *Meter) Export() {
+	m.mux.Lock()
+	end := time.Now()
+	records := make([]*UsageRecord, 0, len(m.records))
+	for _, record := range m.records {
+		record.Start, record.End = m.start, end
+		records = append(records, record)
+	}
+	m.records = map[string]*UsageRecord{}
+	m.start = end
+	m.mux.Unlock()
+
+	if len(records) == 0 {
+		return
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Consumer < records[j].Consumer
+	})
+	if m.dir != "" {
+		if err := m.writeFile(records, end); err != nil {
+			log.Println("Failed to write usage records, error: ", err)
+		}
+	}
+	if m.webhook != "" {
+		m.postPending(records)
+	}
+}
+
+// postPending posts records together with those previous posts failed to deliver, keeping
+// them for the next export when the webhook fails again
+func (m *Meter) postPending(records []*UsageRecord) {
+	m.postMux.Lock()
+	defer m.postMux.Unlock()
+	records = append(m.pending, records...)
+	// keep the pending records of a few intervals at most
+	if limit := 10 * m.MaxConsumers; len(records) > limit {
+		log.Printf("WARNING dropping %d usage records the webhook did not receive\n", len(records)-limit)
+		records = records[len(records)-limit:]
+	}
+	if err := m.post(records); err != nil {
+		log.Printf("Failed to post usage records, keeping %d for the next attempt, error: %s\n", len(records), err)
+		m.pending = records
+		return
+	}
+	m.pending = nil
+}
+
+// writeFile appends records to the file of the current day
+func (m *Meter) writeFile(records []*UsageRecord, end time.Time) error {
+	ext := "ndjson"
+	if m.format == FormatCSV {
+		ext = "csv"
+	}
+	path := filepath.Join(m.dir, fmt.Sprintf("usage-%s.%s", end.Format("2006-01-02"), ext))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if m.format == FormatNDJSON {
+		enc := json.NewEncoder(file)
+		for _, record := range records {
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := csv.NewWriter(file)
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		w.Write([]string{"start", "end", "consumer", "requests", "bytes_in", "bytes_out", "backend_ms"})
+	}
+	for _, record := range records {
+		w.Write([]string{
+			record.Start.Format(time.RFC3339),
+			record.End.Format(time.RFC3339),
+			record.Consumer,
+			strconv.FormatInt(record.Requests, 10),
+			strconv.FormatInt(record.BytesIn, 10),
+			strconv.FormatInt(record.BytesOut, 10),
+			strconv.FormatFloat(record.BackendMs, 'f', 3, 64),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// post sends records as a JSON array to the webhook
+func (m *Meter) post(records []*UsageRecord) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(m.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// GetUsageFromContext returns the usage sample of the request, if it is being metered
+func GetUsageFromContext(r *http.Request) *usageSample {
+	if sample, ok := r.Context().Value(UsageKey).(*usageSample); ok {
+		return sample
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
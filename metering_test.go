@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeterCapsConsumers(t *testing.T) {
+	m, err := NewMeter("header:X-Key", time.Minute, "", FormatNDJSON, "http://127.0.0.1:1", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d", "a"} {
+		m.add("X-Key:"+key, &usageSample{}, 10)
+	}
+	if len(m.records) != 3 {
+		t.Fatalf("expected a, b and other, got %d records", len(m.records))
+	}
+	if other := m.records[overflowConsumer]; other == nil || other.Requests != 2 {
+		t.Fatalf("expected 2 requests accounted to other, got %+v", other)
+	}
+	if m.records["X-Key:a"].Requests != 2 {
+		t.Fatalf("expected known consumers to keep their records")
+	}
+}
+
+func TestMeterRetriesWebhook(t *testing.T) {
+	fail := true
+	var received []*UsageRecord
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer hook.Close()
+
+	m, err := NewMeter("header:X-Key", time.Minute, "", FormatNDJSON, hook.URL, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.add("X-Key:a", &usageSample{}, 1)
+	m.Export()
+	if len(m.pending) != 1 {
+		t.Fatalf("expected the failed record to be kept, got %d", len(m.pending))
+	}
+	fail = false
+	m.add("X-Key:b", &usageSample{}, 1)
+	m.Export()
+	if len(received) != 2 || len(m.pending) != 0 {
+		t.Fatalf("expected both records to be posted, got %d, %d pending", len(received), len(m.pending))
+	}
+}
+
+func TestMeterHashesHeaderConsumers(t *testing.T) {
+	m, err := NewMeter("header:X-Key", time.Minute, "", FormatNDJSON, "http://127.0.0.1:1", 10, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Key", "sk_live_123")
+	consumer := m.Consumer(r)
+	if strings.Contains(consumer, "sk_live_123") || !strings.HasPrefix(consumer, "X-Key:") || len(consumer) != len("X-Key:")+32 {
+		t.Fatalf("expected the hashed header value, got %s", consumer)
+	}
+	if again := m.Consumer(r); again != consumer {
+		t.Fatalf("expected the same identity for the same key, got %s and %s", consumer, again)
+	}
+	r.Header.Set("X-Key", "sk_live_456")
+	if other := m.Consumer(r); other == consumer {
+		t.Fatal("expected another identity for another key")
+	}
+}
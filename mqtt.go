@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	mqttConnect    byte = 0x10
+	mqttConnack    byte = 0x20
+	mqttDisconnect byte = 0xe0
+
+	// mqttServerUnavailable is the CONNACK return code of a broker that cannot serve clients
+	mqttServerUnavailable byte = 3
+
+	mqttMaxConnect int = 1 << 16
+	hashRingPoints int = 100
+)
+
+var errMalformedConnect = errors.New("malformed MQTT CONNECT packet")
+
+// mqttConnectPacket holds the parts of a CONNECT packet needed for routing
+type mqttConnectPacket struct {
+	raw      []byte
+	level    byte
+	clientID string
+}
+
+// readMQTTVarint reads a variable byte integer, returning its value and encoded bytes
+func readMQTTVarint(r io.ByteReader) (int, []byte, error) {
+	value, shift := 0, 0
+	var encoded []byte
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		encoded = append(encoded, b)
+		value |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, encoded, nil
+		}
+		shift += 7
+	}
+	return 0, nil, errMalformedConnect
+}
+
+// readMQTTConnect reads the CONNECT packet a client opens its session with
+func readMQTTConnect(r *bufio.Reader) (*mqttConnectPacket, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if kind != mqttConnect {
+		return nil, fmt.Errorf("expected CONNECT, got packet type %d", kind>>4)
+	}
+	length, encoded, err := readMQTTVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > mqttMaxConnect {
+		return nil, errMalformedConnect
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	p := &mqttConnectPacket{raw: append(append([]byte{kind}, encoded...), body...)}
+
+	// variable header: protocol name, level, flags and keep alive
+	if len(body) < 2 {
+		return nil, errMalformedConnect
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n+4 {
+		return nil, errMalformedConnect
+	}
+	p.level = body[2+n]
+	rest := body[2+n+4:]
+	if p.level == 5 {
+		br := &sliceReader{data: rest}
+		props, _, err := readMQTTVarint(br)
+		if err != nil || len(br.data) < props {
+			return nil, errMalformedConnect
+		}
+		rest = br.data[props:]
+	}
+	if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+		return nil, errMalformedConnect
+	}
+	p.clientID = string(rest[2 : 2+int(binary.BigEndian.Uint16(rest))])
+	return p, nil
+}
+
+// sliceReader reads bytes from a slice
+type sliceReader struct {
+	data []byte
+}
+
+func (s *sliceReader) ReadByte() (byte, error) {
+	if len(s.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := s.data[0]
+	s.data = s.data[1:]
+	return b, nil
+}
+
+// hashPoint is a point of a server on a consistent hash ring
+type hashPoint struct {
+	hash   uint64
+	server *Server
+}
+
+// hashKey hashes key with FNV-1a, finished with the murmur3 mixer so that similar keys
+// spread over the whole ring
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// GetServerByHash returns the server in service owning key on the pool's consistent
+// hash ring, so that keys stay on their server while the pool is unchanged
+func (s *ServerPool) GetServerByHash(key string) *Server {
+	// pools are replaced rather than changed, so the ring is built once
+	s.ringOnce.Do(func() {
+		for _, server := range s.servers {
+			for i := 0; i < hashRingPoints; i++ {
+				s.ring = append(s.ring, hashPoint{hashKey(server.URL.String() + "#" + strconv.Itoa(i)), server})
+			}
+		}
+		sort.Slice(s.ring, func(i, j int) bool {
+			return s.ring[i].hash < s.ring[j].hash
+		})
+	})
+	ring := s.ring
+	if len(ring) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= h
+	})
+	for i := 0; i < len(ring); i++ {
+		if p := ring[(start+i)%len(ring)]; p.server.InService() {
+			return p.server
+		}
+	}
+	return nil
+}
+
+// MQTTProxy routes MQTT clients to the brokers of a pool by their client ID
+type MQTTProxy struct {
+	Pool string
+}
+
+// Serve accepts MQTT clients on port
+func (m *MQTTProxy) Serve(port int) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("MQTT proxy started at :%d\n", port)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("MQTT accept failed, error: ", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !overload.Admit() {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer overload.Done()
+			m.handle(conn)
+		}()
+	}
+}
+
+// handle routes a client by the client ID of its CONNECT packet and relays the session
+func (m *MQTTProxy) handle(client net.Conn) {
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(client)
+	connect, err := readMQTTConnect(r)
+	if err != nil {
+		log.Printf("%s MQTT CONNECT rejected, error: %s\n", client.RemoteAddr(), err)
+		return
+	}
+	client.SetReadDeadline(time.Time{})
+
+	var pool *ServerPool
+	if table := currentRoutes(); table != nil {
+		pool = table.Pools[m.Pool]
+	}
+	if pool == nil {
+		log.Printf("%s MQTT pool %s does not exist\n", client.RemoteAddr(), m.Pool)
+		return
+	}
+	var broker *Server
+	if connect.clientID != "" {
+		broker = pool.GetServerByHash(connect.clientID)
+	} else {
+		// the broker assigns an ID, there is no session to keep together
+		broker = pool.GetNextServer()
+	}
+	if broker == nil {
+		log.Printf("%s MQTT no broker available\n", client.RemoteAddr())
+		return
+	}
+
+	upstream, err := broker.dialTimeout(broker.URL.Host, 5*time.Second)
+	if err != nil {
+		log.Printf("[%s] %s\n", broker.URL.Host, err)
+		if !isEgressError(err) {
+			broker.countFailure()
+		}
+		return
+	}
+	defer upstream.Close()
+	broker.addConnection(1)
+	defer broker.removeConnection(1)
+	if _, err := upstream.Write(connect.raw); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, r)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// isBrokerAlive checks whether an MQTT broker accepts a CONNECT with a CONNACK,
+// returning the round trip time of the TCP handshake or why the broker is not alive
+func isBrokerAlive(b *Server) (time.Duration, error) {
+	conn, rtt, err := b.connectTimed(2 * time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	clientID := fmt.Sprintf("lbsim-probe-%d", time.Now().UnixNano())
+	body := []byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 10}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(clientID)))
+	body = append(body, clientID...)
+	packet := append([]byte{mqttConnect, byte(len(body))}, body...)
+	if _, err := conn.Write(packet); err != nil {
+		return 0, err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return 0, fmt.Errorf("broker did not acknowledge CONNECT: %v", err)
+	}
+	if ack[0] != mqttConnack || ack[1] != 2 {
+		return 0, fmt.Errorf("broker answered CONNECT with packet type %d", ack[0]>>4)
+	}
+	// brokers requiring authentication refuse the probe with 4 or 5, they are alive all the same
+	if ack[3] == mqttServerUnavailable {
+		return 0, fmt.Errorf("broker unavailable")
+	}
+	conn.Write([]byte{mqttDisconnect, 0})
+	return rtt, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+)
+
+// fakeBroker answers the CONNECT of every connection with reply
+func fakeBroker(t *testing.T, reply []byte) *url.URL {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := readMQTTConnect(bufio.NewReader(conn)); err != nil {
+				t.Errorf("expected a well-formed CONNECT, got %v", err)
+			}
+			conn.Write(reply)
+			conn.Close()
+		}
+	}()
+	return &url.URL{Scheme: "mqtt", Host: ln.Addr().String()}
+}
+
+func TestIsBrokerAlive(t *testing.T) {
+	for name, tc := range map[string]struct {
+		reply []byte
+		alive bool
+	}{
+		"accepted":        {[]byte{mqttConnack, 2, 0, 0}, true},
+		"bad credentials": {[]byte{mqttConnack, 2, 0, 4}, true},
+		"not authorized":  {[]byte{mqttConnack, 2, 0, 5}, true},
+		"unavailable":     {[]byte{mqttConnack, 2, 0, mqttServerUnavailable}, false},
+		"not a CONNACK":   {[]byte{0x30, 2, 0, 0}, false},
+		"closed":          {nil, false},
+	} {
+		server := NewServer(fakeBroker(t, tc.reply), "mqtt")
+		if _, err := isBrokerAlive(server); (err == nil) != tc.alive {
+			t.Errorf("%s: expected alive %v, got error %v", name, tc.alive, err)
+		}
+	}
+}
+
+func TestReadMQTTConnect(t *testing.T) {
+	// protocol name, level, flags, keep alive, properties (MQTT 5 only) and client ID
+	v311 := []byte{0x10, 16, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, 4, 'c', 'a', 'r', '1'}
+	v5 := []byte{0x10, 19, 0, 4, 'M', 'Q', 'T', 'T', 5, 0x02, 0, 60, 2, 0x21, 0x10, 0, 4, 'c', 'a', 'r', '2'}
+	for packet, clientID := range map[string]string{string(v311): "car1", string(v5): "car2"} {
+		p, err := readMQTTConnect(bufio.NewReader(bytes.NewReader([]byte(packet))))
+		if err != nil || p.clientID != clientID || string(p.raw) != packet {
+			t.Errorf("expected client ID %s, got %+v, error %v", clientID, p, err)
+		}
+	}
+	for _, malformed := range [][]byte{v311[:10], {0x30, 0}, {0x10, 4, 0, 4, 'M', 'Q'}, {0x10, 0xff, 0xff, 0xff, 0xff}} {
+		if _, err := readMQTTConnect(bufio.NewReader(bytes.NewReader(malformed))); err == nil {
+			t.Errorf("%v: expected an error", malformed)
+		}
+	}
+}
+
+func TestGetServerByHash(t *testing.T) {
+	pool := selectionPool("a", "b", "c")
+	owners := map[string]*Server{}
+	for i := range 100 {
+		key := fmt.Sprintf("client-%d", i)
+		owners[key] = pool.GetServerByHash(key)
+		if pool.GetServerByHash(key) != owners[key] {
+			t.Fatalf("%s: expected the same broker every time", key)
+		}
+	}
+	// only the clients of a failed broker move
+	pool.servers[1].SetAlive(false)
+	moved := 0
+	for key, owner := range owners {
+		server := pool.GetServerByHash(key)
+		if owner != pool.servers[1] && server != owner {
+			t.Fatalf("%s moved from %s to %s", key, owner.URL, server.URL)
+		}
+		if owner == pool.servers[1] {
+			moved++
+			if server == pool.servers[1] {
+				t.Fatalf("%s stayed on the failed broker", key)
+			}
+		}
+	}
+	if moved == 0 || moved == len(owners) {
+		t.Fatalf("expected the keys to spread over the brokers, %d of %d on one", moved, len(owners))
+	}
+}
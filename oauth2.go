@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TokenReplace  string = "replace"
+	TokenPreserve string = "preserve"
+)
+
+// OAuth2Config describes how a pool obtains bearer tokens for its backends
+type OAuth2Config struct {
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes,omitempty"`
+	Audience     string   `json:"audience,omitempty"`
+
+	// Policy is either replace, overwriting the Authorization header of clients, or
+	// preserve, only adding one when the client did not send it
+	Policy string `json:"policy,omitempty"`
+}
+
+// Validate checks that tokens can be requested with the config
+func (c *OAuth2Config) Validate() error {
+	u, err := url.Parse(c.TokenURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("token URL %q is not an absolute URL", c.TokenURL)
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("client ID is required")
+	}
+	switch c.Policy {
+	case "", TokenReplace, TokenPreserve:
+	default:
+		return fmt.Errorf("unknown token policy %q", c.Policy)
+	}
+	return nil
+}
+
+// TokenSource requests tokens with the client credentials grant and caches them
+type TokenSource struct {
+	Config  OAuth2Config
+	mux     sync.Mutex
+	token   string
+	refresh time.Time
+	expires time.Time
+	client  http.Client
+
+	// done is closed when the token request in progress finishes, nil while none is
+	done chan struct{}
+	// err is the error of the last failed request, no new request is made before retry
+	err      error
+	failures int
+	retry    time.Time
+}
+
+// NewTokenSource returns a token source for the config
+func NewTokenSource(cfg OAuth2Config) *TokenSource {
+	return &TokenSource{Config: cfg, client: http.Client{Timeout: 10 * time.Second}}
+}
+
+// Token returns a cached token, requesting a new one in the background once the cached
+// token is within a tenth of its lifetime, and at least 30 seconds unless it is very short
+// lived, of expiring. Without a valid token it waits for a request to the token endpoint.
+func (t *TokenSource) Token() (string, error) {
+	t.mux.Lock()
+	now := time.Now()
+	if t.token != "" && now.Before(t.expires) {
+		if !now.Before(t.refresh) && t.done == nil && !now.Before(t.retry) {
+			t.done = make(chan struct{})
+			go t.update()
+		}
+		token := t.token
+		t.mux.Unlock()
+		return token, nil
+	}
+	if t.done == nil {
+		if now.Before(t.retry) {
+			err := t.err
+			t.mux.Unlock()
+			return "", err
+		}
+		t.done = make(chan struct{})
+		go t.update()
+	}
+	done := t.done
+	t.mux.Unlock()
+
+	<-done
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.token != "" && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+	return "", t.err
+}
+
+// update requests a token and caches it, backing off after failures
+func (t *TokenSource) update() {
+	token, lifetime, err := t.fetch()
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	now := time.Now()
+	if err != nil {
+		t.failures++
+		t.err = err
+		t.retry = now.Add(min(time.Second<<min(t.failures-1, 6), time.Minute))
+		log.Printf("Failed to request token from %s, retrying in %s, error: %v\n", t.Config.TokenURL, t.retry.Sub(now), err)
+	} else {
+		t.token = token
+		t.expires = now.Add(lifetime)
+		t.refresh = t.expires.Add(-min(max(lifetime/10, 30*time.Second), lifetime/2))
+		t.err, t.failures, t.retry = nil, 0, time.Time{}
+	}
+	close(t.done)
+	t.done = nil
+}
+
+// fetch requests a token from the token endpoint
+func (t *TokenSource) fetch() (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(t.Config.Scopes) > 0 {
+		form.Set("scope", strings.Join(t.Config.Scopes, " "))
+	}
+	if t.Config.Audience != "" {
+		form.Set("audience", t.Config.Audience)
+	}
+	req, err := http.NewRequest(http.MethodPost, t.Config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(t.Config.ClientID), url.QueryEscape(t.Config.ClientSecret))
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", 0, fmt.Errorf("token endpoint responded with %s %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", 0, err
+	}
+	if body.AccessToken == "" {
+		return "", 0, fmt.Errorf("token endpoint returned no access token")
+	}
+	if body.TokenType != "" && !strings.EqualFold(body.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported token type %q", body.TokenType)
+	}
+	lifetime := time.Duration(body.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		// no expiry given, refresh every hour to be safe
+		lifetime = time.Hour
+	}
+	return body.AccessToken, lifetime, nil
+}
+
+// Authorize sets the Authorization header of an upstream request according to the policy
+func (t *TokenSource) Authorize(r *http.Request) error {
+	if t.Config.Policy == TokenPreserve && r.Header.Get("Authorization") != "" {
+		return nil
+	}
+	token, err := t.Token()
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenStub is a token endpoint counting its requests, it fails while failing is set and
+// holds requests while hold is not nil
+type tokenStub struct {
+	requests atomic.Int64
+	failing  atomic.Bool
+	hold     chan struct{}
+}
+
+func (s *tokenStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := s.requests.Add(1)
+	if s.hold != nil {
+		<-s.hold
+	}
+	if id, secret, ok := r.BasicAuth(); !ok || id != "lbsim" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" {
+		http.Error(w, "invalid_client", http.StatusUnauthorized)
+		return
+	}
+	if s.failing.Load() {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": 3600}`, n)
+}
+
+func newTokenStub(t *testing.T) (*tokenStub, *TokenSource) {
+	stub := &tokenStub{}
+	endpoint := httptest.NewServer(stub)
+	t.Cleanup(endpoint.Close)
+	return stub, NewTokenSource(OAuth2Config{TokenURL: endpoint.URL, ClientID: "lbsim", ClientSecret: "secret"})
+}
+
+func TestTokenSourceCaches(t *testing.T) {
+	stub, source := newTokenStub(t)
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := source.Token(); err != nil || token != "token-1" {
+				t.Errorf("got token %q, error %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := stub.requests.Load(); n != 1 {
+		t.Fatalf("expected concurrent callers to share 1 token request, got %d", n)
+	}
+}
+
+func TestTokenSourceRefreshesInBackground(t *testing.T) {
+	stub, source := newTokenStub(t)
+	if _, err := source.Token(); err != nil {
+		t.Fatal(err)
+	}
+	stub.hold = make(chan struct{})
+	source.mux.Lock()
+	source.refresh = time.Now().Add(-time.Second)
+	source.mux.Unlock()
+
+	start := time.Now()
+	if token, err := source.Token(); err != nil || token != "token-1" {
+		t.Fatalf("expected the cached token during the refresh, got %q, error %v", token, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("expected the refresh not to block callers")
+	}
+	close(stub.hold)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if token, _ := source.Token(); token == "token-2" {
+			return
+		}
+	}
+	t.Fatal("expected the refreshed token")
+}
+
+func TestTokenSourceBacksOff(t *testing.T) {
+	stub, source := newTokenStub(t)
+	stub.failing.Store(true)
+	if _, err := source.Token(); err == nil {
+		t.Fatal("expected an error without a token")
+	}
+	if _, err := source.Token(); err == nil {
+		t.Fatal("expected the error to be kept during the backoff")
+	}
+	if n := stub.requests.Load(); n != 1 {
+		t.Fatalf("expected no token request during the backoff, got %d", n)
+	}
+
+	stub.failing.Store(false)
+	source.mux.Lock()
+	source.retry = time.Time{}
+	source.mux.Unlock()
+	if token, err := source.Token(); err != nil || token != "token-2" {
+		t.Fatalf("expected a token after the backoff, got %q, error %v", token, err)
+	}
+}
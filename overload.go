@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+const heapMetric string = "/memory/classes/heap/objects:bytes"
+
+// OverloadState describes the load of the load balancer itself
+type OverloadState struct {
+	Overloaded bool   `json:"overloaded"`
+	Reason     string `json:"reason,omitempty"`
+	InFlight   int64  `json:"in_flight"`
+	Goroutines int    `json:"goroutines"`
+	HeapBytes  uint64 `json:"heap_bytes"`
+	Rejected   int64  `json:"rejected"`
+}
+
+// OverloadGuard rejects new requests while the load balancer is over one of its limits,
+// so that it degrades predictably instead of running out of memory or scheduling time
+type OverloadGuard struct {
+	MaxInFlight   int64
+	MaxGoroutines int
+	MaxHeap       uint64
+	inFlight      atomic.Int64
+	heap          atomic.Uint64
+	rejected      atomic.Int64
+	overloaded    atomic.Bool
+	reason        atomic.Pointer[string]
+}
+
+// NewOverloadGuard limits in-flight requests, goroutines and heap bytes, a zero limit is not enforced
+func NewOverloadGuard(maxInFlight int64, maxGoroutines int, maxHeap uint64) *OverloadGuard {
+	return &OverloadGuard{MaxInFlight: maxInFlight, MaxGoroutines: maxGoroutines, MaxHeap: maxHeap}
+}
+
+// Run samples the heap size, which is too expensive to read for every request
+func (g *OverloadGuard) Run() {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	t := time.NewTicker(500 * time.Millisecond)
+	for {
+		metrics.Read(sample)
+		if sample[0].Value.Kind() == metrics.KindUint64 {
+			g.heap.Store(sample[0].Value.Uint64())
+		}
+		g.check(g.inFlight.Load())
+		select {
+		case <-t.C:
+		}
+	}
+}
+
+// evaluate returns the limit the load balancer is over, or an empty string
+func (g *OverloadGuard) evaluate(inFlight int64) string {
+	switch {
+	case g.MaxInFlight > 0 && inFlight > g.MaxInFlight:
+		return "in-flight requests"
+	case g.MaxGoroutines > 0 && runtime.NumGoroutine() > g.MaxGoroutines:
+		return "goroutines"
+	case g.MaxHeap > 0 && g.heap.Load() > g.MaxHeap:
+		return "heap"
+	}
+	return ""
+}
+
+// check evaluates the limits, updates the overload state and logs its changes
+func (g *OverloadGuard) check(inFlight int64) string {
+	reason := g.evaluate(inFlight)
+	g.reason.Store(&reason)
+	if overloaded := reason != ""; g.overloaded.Swap(overloaded) != overloaded {
+		if overloaded {
+			log.Printf("Load balancer overloaded (%s), rejecting new requests\n", reason)
+		} else {
+			log.Printf("Load balancer recovered from overload, %d requests rejected\n", g.rejected.Load())
+		}
+	}
+	return reason
+}
+
+// Overloaded returns true while new requests are rejected, false for a nil guard
+func (g *OverloadGuard) Overloaded() bool {
+	return g != nil && g.overloaded.Load()
+}
+
+// State returns the current load and whether new requests are rejected, without
+// changing the state
+func (g *OverloadGuard) State() OverloadState {
+	reason := ""
+	if r := g.reason.Load(); r != nil {
+		reason = *r
+	}
+	return OverloadState{
+		Overloaded: g.overloaded.Load(),
+		Reason:     reason,
+		InFlight:   g.inFlight.Load(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  g.heap.Load(),
+		Rejected:   g.rejected.Load(),
+	}
+}
+
+// Admit counts a request, or a connection of the MQTT and SOCKS5 proxies, as in flight
+// until Done, returning false after counting it as rejected while overloaded. A nil
+// guard admits everything.
+func (g *OverloadGuard) Admit() bool {
+	if g == nil {
+		return true
+	}
+	if g.check(g.inFlight.Add(1)) != "" {
+		g.inFlight.Add(-1)
+		g.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+// Done ends a request or connection admitted by Admit
+func (g *OverloadGuard) Done() {
+	if g != nil {
+		g.inFlight.Add(-1)
+	}
+}
+
+// Middleware rejects requests with 503 before any work is done for them while overloaded
+func (g *OverloadGuard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.Admit() {
+			w.Header().Set("Retry-After", "1")
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Load balancer overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		defer g.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP reports the overload state on the admin API, with 503 while overloaded
+func (g *OverloadGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state := g.State()
+	status := http.StatusOK
+	if state.Overloaded {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, state)
+}
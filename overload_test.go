@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestOverloadGuard(t *testing.T) {
+	g := NewOverloadGuard(1, 0, 0)
+	if !g.Admit() {
+		t.Fatal("expected the first request to be admitted")
+	}
+	if g.Admit() {
+		t.Fatal("expected the second request to be rejected")
+	}
+	g.Done()
+	// reading the state does not change it
+	if state := g.State(); !state.Overloaded || state.Rejected != 1 || state.InFlight != 0 {
+		t.Fatalf("expected the overload to be reported until the next check, got %+v", state)
+	}
+	if !g.Admit() || g.Overloaded() {
+		t.Fatal("expected the guard to recover once requests finished")
+	}
+
+	var none *OverloadGuard
+	if !none.Admit() || none.Overloaded() {
+		t.Fatal("expected a nil guard to admit everything")
+	}
+	none.Done()
+}
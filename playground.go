@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const (
+	playgroundMaxServers  int = 20
+	playgroundMaxRequests int = 2000
+)
+
+// PlaygroundServer is a virtual backend taking ServiceMs to answer a request, RTTMs away
+type PlaygroundServer struct {
+	Name      string            `json:"name"`
+	Weight    int               `json:"weight,omitempty"`
+	ServiceMs float64           `json:"service_ms"`
+	RTTMs     float64           `json:"rtt_ms,omitempty"`
+	Zone      string            `json:"zone,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// PlaygroundEvent marks a virtual backend up or down before the given request is balanced
+type PlaygroundEvent struct {
+	Request int    `json:"request"`
+	Server  string `json:"server"`
+	Alive   bool   `json:"alive"`
+}
+
+// PlaygroundScenario is a virtual fleet and the traffic sent to it, one request every
+// IntervalMs with costs taken from Costs in turn
+type PlaygroundScenario struct {
+	Algorithm      string             `json:"algorithm"`
+	Filters        []string           `json:"filters,omitempty"`
+	Labels         map[string]string  `json:"labels,omitempty"`
+	MaxConnections int                `json:"max_connections,omitempty"`
+	Servers        []PlaygroundServer `json:"servers"`
+	Requests       int                `json:"requests"`
+	IntervalMs     float64            `json:"interval_ms"`
+	Costs          []float64          `json:"costs,omitempty"`
+	Events         []PlaygroundEvent  `json:"events,omitempty"`
+}
+
+// PlaygroundStep is the state of the fleet right after a request was balanced
+type PlaygroundStep struct {
+	Request int       `json:"request"`
+	TimeMs  float64   `json:"time_ms"`
+	Cost    float64   `json:"cost"`
+	Chosen  string    `json:"chosen,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Events  []string  `json:"events,omitempty"`
+	InQueue []int     `json:"in_queue"`
+	Pending []float64 `json:"pending_cost"`
+	Alive   []bool    `json:"alive"`
+	Served  []int     `json:"served"`
+}
+
+// PlaygroundResult lists the steps of a simulated scenario
+type PlaygroundResult struct {
+	Servers []string         `json:"servers"`
+	Steps   []PlaygroundStep `json:"steps"`
+}
+
+// Validate checks that the scenario can be simulated
+func (sc *PlaygroundScenario) Validate() error {
+	if len(sc.Servers) == 0 || len(sc.Servers) > playgroundMaxServers {
+		return fmt.Errorf("a scenario needs between 1 and %d servers", playgroundMaxServers)
+	}
+	if sc.Requests <= 0 || sc.Requests > playgroundMaxRequests {
+		return fmt.Errorf("a scenario needs between 1 and %d requests", playgroundMaxRequests)
+	}
+	if sc.IntervalMs < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	names := map[string]bool{}
+	for _, s := range sc.Servers {
+		if s.Name == "" || names[s.Name] {
+			return fmt.Errorf("server names must be unique and not empty")
+		}
+		if s.ServiceMs < 0 || s.Weight < 0 || s.RTTMs < 0 {
+			return fmt.Errorf("server %s: service time, RTT and weight must not be negative", s.Name)
+		}
+		names[s.Name] = true
+	}
+	for _, e := range sc.Events {
+		if !names[e.Server] {
+			return fmt.Errorf("event refers to unknown server %q", e.Server)
+		}
+	}
+	for _, cost := range sc.Costs {
+		if cost < 0 {
+			return fmt.Errorf("costs must not be negative")
+		}
+	}
+	return nil
+}
+
+// Simulate balances the scenario's requests over a virtual pool with the same pipeline
+// and algorithm implementations as real traffic, in simulated time
+func (sc *PlaygroundScenario) Simulate() (*PlaygroundResult, error) {
+	if err := sc.Validate(); err != nil {
+		return nil, err
+	}
+	pipeline, err := NewPipeline(sc.Filters, sc.Labels, 0, sc.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	pool := &ServerPool{Name: "playground", Algorithm: sc.Algorithm, MaxConnections: sc.MaxConnections}
+	byName := map[string]int{}
+	result := &PlaygroundResult{}
+	for i, ps := range sc.Servers {
+		server := NewServer(&url.URL{Scheme: "http", Host: url.PathEscape(ps.Name) + ".playground.invalid"}, pool.Name)
+		server.SetWeight(ps.Weight)
+		server.SetPlacement(ps.Zone, ps.Labels)
+		server.recordRTT(time.Duration(ps.RTTMs * float64(time.Millisecond)))
+		pool.AddServer(server)
+		byName[ps.Name] = i
+		result.Servers = append(result.Servers, ps.Name)
+	}
+	costs := sc.Costs
+	if len(costs) == 0 {
+		costs = []float64{1}
+	}
+
+	type completion struct {
+		at     float64
+		server int
+		cost   float64
+	}
+	var inFlight []completion
+	served := make([]int, len(pool.servers))
+	for n := 1; n <= sc.Requests; n++ {
+		now := float64(n-1) * sc.IntervalMs
+		step := PlaygroundStep{Request: n, TimeMs: now, Cost: costs[(n-1)%len(costs)]}
+
+		// requests finishing before this one arrives leave their servers first
+		sort.Slice(inFlight, func(i, j int) bool { return inFlight[i].at < inFlight[j].at })
+		for len(inFlight) > 0 && inFlight[0].at <= now {
+			pool.servers[inFlight[0].server].removeConnection(inFlight[0].cost)
+			inFlight = inFlight[1:]
+		}
+		for _, e := range sc.Events {
+			if e.Request == n {
+				pool.servers[byName[e.Server]].SetAlive(e.Alive)
+				state := "down"
+				if e.Alive {
+					state = "up"
+				}
+				step.Events = append(step.Events, e.Server+" "+state)
+			}
+		}
+
+		server, err := pipeline.Select(pool)
+		if err != nil {
+			step.Reason = err.Error()
+		}
+		for i, s := range pool.servers {
+			if s == server {
+				s.addConnection(step.Cost)
+				served[i]++
+				step.Chosen = sc.Servers[i].Name
+				inFlight = append(inFlight, completion{now + sc.Servers[i].ServiceMs, i, step.Cost})
+			}
+		}
+		for i, s := range pool.servers {
+			step.InQueue = append(step.InQueue, s.Connections())
+			step.Pending = append(step.Pending, s.OutstandingCost())
+			step.Alive = append(step.Alive, s.IsAlive())
+			step.Served = append(step.Served, served[i])
+		}
+		result.Steps = append(result.Steps, step)
+	}
+	return result, nil
+}
+
+// servePlayground serves the playground page, and simulates the scenarios it posts
+func servePlayground(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(playgroundPage))
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use GET or POST"})
+		return
+	}
+	sc := &PlaygroundScenario{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(sc); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	result, err := sc.Simulate()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// servePlaygroundReplay simulates the requests of a posted decision log, to compare the decisions
+// made in production with those of the same or another algorithm
+func servePlaygroundReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+		return
+	}
+	sc, logged, err := ReplayScenario(http.MaxBytesReader(w, r.Body, 64<<20), r.URL.Query().Get("pool"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if algorithm := r.URL.Query().Get("algorithm"); algorithm != "" {
+		sc.Algorithm = algorithm
+	}
+	result, err := sc.Simulate()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"scenario": sc, "logged": logged, "result": result})
+}
+
+const playgroundPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Load balancer playground</title>
+<style>
+body { font-family: sans-serif; margin: 20px; display: flex; gap: 30px; }
+form { width: 340px; }
+label { display: block; margin-top: 10px; font-size: 13px; }
+input, select, textarea { width: 100%; box-sizing: border-box; font-family: monospace; }
+textarea { height: 90px; }
+button { margin: 10px 4px 0 0; }
+#fleet { flex: 1; }
+.server { display: flex; align-items: center; margin: 6px 0; transition: opacity .2s; }
+.server.down { opacity: .35; }
+.name { width: 90px; font-family: monospace; }
+.track { flex: 1; height: 26px; background: #eee; position: relative; }
+.bar { height: 100%; background: #6a9fd8; transition: width .2s; }
+.server.chosen .bar { background: #e8a33d; }
+.stats { width: 190px; font-size: 12px; padding-left: 8px; font-family: monospace; }
+#status { margin: 10px 0; font-family: monospace; min-height: 3em; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<form id="scenario">
+<h3>Scenario</h3>
+<label>Algorithm
+<select name="algorithm"><option>RoundRobin</option><option>LeastConnection</option><option>WeightedRoundRobin</option><option>LeastCost</option></select></label>
+<label>Servers, one per line: name weight service_ms [zone]
+<textarea name="servers">a 1 200
+b 2 200
+c 1 600</textarea></label>
+<label>Filters, comma separated (empty for alive,not_draining)
+<input name="filters" value=""></label>
+<label>Requests <input name="requests" type="number" value="60"></label>
+<label>Interval between requests (ms) <input name="interval" type="number" value="50"></label>
+<label>Request costs, cycled <input name="costs" value="1"></label>
+<label>Health flips, one per line: request server up|down
+<textarea name="events">20 b down
+40 b up</textarea></label>
+<button type="submit">Simulate</button>
+</form>
+<div id="fleet">
+<h3>Fleet</h3>
+<div>
+<button id="back">&#9664; Step</button><button id="play">Play</button><button id="next">Step &#9654;</button>
+<input id="speed" type="range" min="20" max="1000" value="200" style="width:200px"> ms per step
+</div>
+<div id="status"></div>
+<div id="servers"></div>
+</div>
+<script>
+var result = null, current = -1, timer = null;
+var form = document.getElementById("scenario");
+
+function lines(text) {
+  return text.split("\n").map(function (l) { return l.trim().split(/\s+/); }).filter(function (f) { return f[0] !== ""; });
+}
+
+function scenario() {
+  return {
+    algorithm: form.algorithm.value,
+    servers: lines(form.servers.value).map(function (f) {
+      return {name: f[0], weight: parseInt(f[1] || "1"), service_ms: parseFloat(f[2] || "100"), zone: f[3] || ""};
+    }),
+    filters: form.filters.value.split(",").map(function (f) { return f.trim(); }).filter(Boolean),
+    requests: parseInt(form.requests.value),
+    interval_ms: parseFloat(form.interval.value),
+    costs: form.costs.value.split(",").map(parseFloat).filter(function (c) { return !isNaN(c); }),
+    events: lines(form.events.value).map(function (f) {
+      return {request: parseInt(f[0]), server: f[1], alive: f[2] === "up"};
+    })
+  };
+}
+
+// el creates an element with a class and text, names and errors are never parsed as HTML
+function el(tag, cls, text) {
+  var e = document.createElement(tag);
+  if (cls) {
+    e.className = cls;
+  }
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  return e;
+}
+
+function showError(message) {
+  var status = document.getElementById("status");
+  status.replaceChildren(el("span", "error", message));
+}
+
+function render() {
+  var step = result.steps[current];
+  var max = 1;
+  result.steps.forEach(function (s) { s.in_queue.forEach(function (q) { max = Math.max(max, q); }); });
+  var rows = result.servers.map(function (name, i) {
+    var row = el("div", "server" + (step.alive[i] ? "" : " down") + (step.chosen === name ? " chosen" : ""));
+    var track = el("div", "track");
+    var bar = el("div", "bar");
+    bar.style.width = (100 * step.in_queue[i] / max) + "%";
+    track.appendChild(bar);
+    var stats = el("div", "stats", "in flight " + step.in_queue[i] + ", cost " + step.pending_cost[i]);
+    stats.appendChild(document.createElement("br"));
+    stats.appendChild(document.createTextNode("served " + step.served[i]));
+    row.append(el("div", "name", name), track, stats);
+    return row;
+  });
+  var servers = document.getElementById("servers");
+  servers.replaceChildren.apply(servers, rows);
+  var status = document.getElementById("status");
+  status.replaceChildren(document.createTextNode("request " + step.request + "/" + result.steps.length + " at " + step.time_ms + "ms (cost " + step.cost + "): "));
+  if (step.chosen) {
+    status.appendChild(document.createTextNode("sent to " + step.chosen));
+  } else {
+    status.appendChild(el("span", "error", step.reason));
+  }
+  if (step.events) {
+    status.appendChild(document.createElement("br"));
+    status.appendChild(document.createTextNode("health: " + step.events.join(", ")));
+  }
+}
+
+function move(delta) {
+  if (!result) {
+    return false;
+  }
+  var to = Math.min(Math.max(current + delta, 0), result.steps.length - 1);
+  if (to === current) {
+    return false;
+  }
+  current = to;
+  render();
+  return true;
+}
+
+function stop() {
+  clearInterval(timer);
+  timer = null;
+  document.getElementById("play").textContent = "Play";
+}
+
+form.onsubmit = function (e) {
+  e.preventDefault();
+  stop();
+  fetch(location.pathname, {method: "POST", body: JSON.stringify(scenario())})
+    .then(function (resp) { return resp.json(); })
+    .then(function (body) {
+      if (body.error) {
+        showError(body.error);
+        return;
+      }
+      result = body;
+      current = -1;
+      move(1);
+    });
+};
+document.getElementById("next").onclick = function () { stop(); move(1); };
+document.getElementById("back").onclick = function () { stop(); move(-1); };
+document.getElementById("play").onclick = function () {
+  if (timer) {
+    stop();
+    return;
+  }
+  this.textContent = "Pause";
+  timer = setInterval(function () {
+    if (!move(1)) {
+      stop();
+    }
+  }, parseInt(document.getElementById("speed").value));
+};
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPlaygroundSimulate(t *testing.T) {
+	sc := &PlaygroundScenario{
+		Algorithm:  LeastConnection,
+		Servers:    []PlaygroundServer{{Name: "fast", ServiceMs: 10}, {Name: "slow", ServiceMs: 1000}},
+		Requests:   10,
+		IntervalMs: 20,
+		Events:     []PlaygroundEvent{{Request: 8, Server: "fast", Alive: false}},
+	}
+	result, err := sc.Simulate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Steps) != 10 {
+		t.Fatalf("expected a step per request, got %d", len(result.Steps))
+	}
+	// the slow server keeps its first request, the fast one is free again for every other
+	for _, step := range result.Steps[1:7] {
+		if step.Chosen != "fast" {
+			t.Fatalf("request %d: expected the idle fast server, got %s", step.Request, step.Chosen)
+		}
+	}
+	last := result.Steps[9]
+	if result.Steps[7].Events[0] != "fast down" || last.Chosen != "slow" || last.Alive[0] || last.InQueue[1] != 3 {
+		t.Fatalf("expected the slow server to take over once the fast one is down, got %+v", last)
+	}
+
+	for _, invalid := range []*PlaygroundScenario{
+		{Servers: []PlaygroundServer{{Name: "a"}}, Requests: 0},
+		{Servers: []PlaygroundServer{{Name: "a"}, {Name: "a"}}, Requests: 1},
+		{Servers: []PlaygroundServer{{Name: "a"}}, Requests: 1, Events: []PlaygroundEvent{{Request: 1, Server: "b"}}},
+		{Servers: []PlaygroundServer{{Name: "a", ServiceMs: -1}}, Requests: 1},
+		{Algorithm: "Random", Servers: []PlaygroundServer{{Name: "a"}}, Requests: 1},
+	} {
+		if _, err := invalid.Simulate(); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestServePlayground(t *testing.T) {
+	w := httptest.NewRecorder()
+	servePlayground(w, httptest.NewRequest("GET", "/playground", nil))
+	// server names and errors come from users, the page must not parse them as HTML
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "innerHTML") || !strings.Contains(w.Body.String(), "textContent") {
+		t.Fatalf("expected the page to set text only, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	servePlayground(w, httptest.NewRequest("POST", "/playground", strings.NewReader(
+		`{"algorithm": "RoundRobin", "servers": [{"name": "<img src=x onerror=alert(1)>"}], "requests": 2}`)))
+	var result PlaygroundResult
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &result) != nil || result.Steps[1].Chosen != "<img src=x onerror=alert(1)>" {
+		t.Fatalf("expected the simulated steps, got %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	servePlayground(w, httptest.NewRequest("POST", "/playground", strings.NewReader(`{"servers": []}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid scenario to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	probeWindow int = 60
+
+	// probeHeader carries the prober's token, marking requests as its own
+	probeHeader string = "X-Lbsim-Probe"
+)
+
+// ProbeConfig is a synthetic request sent through the load balancer's own listener, and
+// what its response has to look like
+type ProbeConfig struct {
+	Name     string            `json:"name"`
+	Method   string            `json:"method,omitempty"`
+	Host     string            `json:"host,omitempty"`
+	Path     string            `json:"path"`
+	Header   map[string]string `json:"header,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Interval string            `json:"interval,omitempty"`
+	Timeout  string            `json:"timeout,omitempty"`
+
+	// ExpectStatus defaults to 200, ExpectBody is a substring the body has to contain
+	ExpectStatus int    `json:"expect_status,omitempty"`
+	ExpectBody   string `json:"expect_body,omitempty"`
+	MaxLatency   string `json:"max_latency,omitempty"`
+}
+
+// ProbeState is the outcome of a probe's recent runs reported on the admin API
+type ProbeState struct {
+	Name         string    `json:"name"`
+	Route        string    `json:"route"`
+	Runs         int64     `json:"runs"`
+	Failures     int64     `json:"failures"`
+	Availability float64   `json:"availability"`
+	LastRun      time.Time `json:"last_run"`
+	LastStatus   int       `json:"last_status"`
+	LatencyMs    float64   `json:"latency_ms"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// probe is a configured probe and the results of its last runs
+type probe struct {
+	ProbeConfig
+	interval   time.Duration
+	timeout    time.Duration
+	maxLatency time.Duration
+	state      ProbeState
+	recent     []bool
+}
+
+// Prober runs synthetic probes against the load balancer's listener at BaseURL
+type Prober struct {
+	BaseURL string
+	probes  []*probe
+	mux     sync.Mutex
+	client  http.Client
+	token   string
+}
+
+// NewProber loads the probes in the JSON file at path, to be sent to baseUrl
+func NewProber(path string, baseUrl string) (*Prober, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []ProbeConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	token := make([]byte, 16)
+	rand.Read(token)
+	p := &Prober{BaseURL: baseUrl, token: hex.EncodeToString(token)}
+	p.client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	// the listener's certificate is the load balancer's own, probes test routing rather than it
+	p.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	names := map[string]bool{}
+	for _, cfg := range configs {
+		if cfg.Name == "" || names[cfg.Name] {
+			return nil, errors.New("probe names must be unique and not empty")
+		}
+		names[cfg.Name] = true
+		if !strings.HasPrefix(cfg.Path, "/") {
+			return nil, fmt.Errorf("probe %s: path %q must start with /", cfg.Name, cfg.Path)
+		}
+		pr := &probe{ProbeConfig: cfg, interval: 30 * time.Second, timeout: 5 * time.Second}
+		for _, d := range []struct {
+			value  string
+			target *time.Duration
+		}{{cfg.Interval, &pr.interval}, {cfg.Timeout, &pr.timeout}, {cfg.MaxLatency, &pr.maxLatency}} {
+			if d.value == "" {
+				continue
+			}
+			if *d.target, err = time.ParseDuration(d.value); err != nil || *d.target <= 0 {
+				return nil, fmt.Errorf("probe %s: invalid duration %q", cfg.Name, d.value)
+			}
+		}
+		if pr.Method == "" {
+			pr.Method = http.MethodGet
+		}
+		if pr.ExpectStatus == 0 {
+			pr.ExpectStatus = http.StatusOK
+		}
+		pr.state.Name = cfg.Name
+		p.probes = append(p.probes, pr)
+	}
+	return p, nil
+}
+
+// Run sends every probe right away and then at its interval
+func (p *Prober) Run() {
+	for _, pr := range p.probes {
+		go func(pr *probe) {
+			p.run(pr)
+			t := time.NewTicker(pr.interval)
+			for {
+				select {
+				case <-t.C:
+					p.run(pr)
+				}
+			}
+		}(pr)
+	}
+}
+
+// run sends a probe and records whether its response met the expectations
+func (p *Prober) run(pr *probe) {
+	route, status, latency, err := p.send(pr)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	wasFailing := pr.state.LastError != ""
+	pr.state.Route = route
+	pr.state.Runs++
+	pr.state.LastRun = time.Now()
+	pr.state.LastStatus = status
+	pr.state.LatencyMs = milliseconds(latency)
+	pr.state.LastError = ""
+	if err != nil {
+		pr.state.Failures++
+		pr.state.LastError = err.Error()
+	}
+	pr.recent = append(pr.recent, err == nil)
+	if len(pr.recent) > probeWindow {
+		pr.recent = pr.recent[1:]
+	}
+	pr.state.Availability = availability(pr.recent)
+
+	switch {
+	case err != nil && !wasFailing:
+		log.Printf("WARNING probe %s (route %s) failed: %s\n", pr.Name, route, err)
+	case err == nil && wasFailing:
+		log.Printf("Probe %s (route %s) recovered\n", pr.Name, route)
+	}
+}
+
+// send makes the probe's request, returning the route it matches and what went wrong
+func (p *Prober) send(pr *probe) (string, int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pr.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, pr.Method, p.BaseURL+pr.Path, strings.NewReader(pr.Body))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	for key, value := range pr.Header {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("User-Agent", "lbsim-probe")
+	req.Header.Set(probeHeader, p.token)
+	if pr.Host != "" {
+		req.Host = pr.Host
+	}
+	route := "none"
+	if table := currentRoutes(); table != nil {
+		if matched := table.Match(req); matched != nil {
+			route = matched.Host + matched.Prefix
+		}
+	}
+
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return route, 0, time.Since(start), err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	latency := time.Since(start)
+	switch {
+	case err != nil:
+		return route, resp.StatusCode, latency, err
+	case resp.StatusCode != pr.ExpectStatus:
+		return route, resp.StatusCode, latency, fmt.Errorf("status %d, expected %d", resp.StatusCode, pr.ExpectStatus)
+	case pr.ExpectBody != "" && !strings.Contains(string(body), pr.ExpectBody):
+		return route, resp.StatusCode, latency, fmt.Errorf("body does not contain %q", pr.ExpectBody)
+	case pr.maxLatency > 0 && latency > pr.maxLatency:
+		return route, resp.StatusCode, latency, fmt.Errorf("latency %s over %s", latency.Round(time.Millisecond), pr.maxLatency)
+	}
+	return route, resp.StatusCode, latency, nil
+}
+
+// Middleware marks the probes' own requests, so that they are not metered, captured as
+// dead letters or logged as balancing decisions. The header is removed from every request.
+func (p *Prober) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probe := subtle.ConstantTimeCompare([]byte(r.Header.Get(probeHeader)), []byte(p.token)) == 1
+		r.Header.Del(probeHeader)
+		if probe {
+			r = r.WithContext(context.WithValue(r.Context(), ProbeKey, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IsProbe returns true for requests of the synthetic probes
+func IsProbe(r *http.Request) bool {
+	probe, _ := r.Context().Value(ProbeKey).(bool)
+	return probe
+}
+
+// availability returns the fraction of successful runs
+func availability(results []bool) float64 {
+	if len(results) == 0 {
+		return 1
+	}
+	ok := 0
+	for _, success := range results {
+		if success {
+			ok++
+		}
+	}
+	return float64(ok) / float64(len(results))
+}
+
+// States returns the state of every probe
+func (p *Prober) States() []ProbeState {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	states := []ProbeState{}
+	for _, pr := range p.probes {
+		states = append(states, pr.state)
+	}
+	return states
+}
+
+// RouteAvailability returns the fraction of successful recent probe runs of every route probed
+func (p *Prober) RouteAvailability() map[string]float64 {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	results := map[string][]bool{}
+	for _, pr := range p.probes {
+		if pr.state.Runs > 0 {
+			results[pr.state.Route] = append(results[pr.state.Route], pr.recent...)
+		}
+	}
+	routes := map[string]float64{}
+	for route, r := range results {
+		routes[route] = availability(r)
+	}
+	return routes
+}
+
+// ServeHTTP reports the probes and the availability of the routes they probe
+func (p *Prober) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	states := p.States()
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"probes": states, "routes": p.RouteAvailability()})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProberRunsAndTagsProbes(t *testing.T) {
+	probed := make(chan bool, 10)
+	var prober *Prober
+	lb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prober.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(probeHeader) != "" {
+				t.Error("expected the probe header to be removed")
+			}
+			probed <- IsProbe(r)
+		})).ServeHTTP(w, r)
+	}))
+	defer lb.Close()
+
+	path := filepath.Join(t.TempDir(), "probes.json")
+	os.WriteFile(path, []byte(`[{"name": "health", "path": "/health", "interval": "1h"}]`), 0644)
+	var err error
+	if prober, err = NewProber(path, lb.URL); err != nil {
+		t.Fatal(err)
+	}
+	prober.Run()
+	select {
+	case isProbe := <-probed:
+		if !isProbe {
+			t.Fatal("expected the request to be marked as a probe")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the probe to run right away")
+	}
+
+	// clients can't pass their requests off as probes
+	r, _ := http.NewRequest("GET", lb.URL+"/health", nil)
+	r.Header.Set(probeHeader, "guess")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if <-probed {
+		t.Fatal("expected a client request not to be marked as a probe")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const defaultProximityMargin time.Duration = 5 * time.Millisecond
+
+// recordRTT folds a handshake round trip time into the smoothed RTT estimate
+func (b *Server) recordRTT(d time.Duration) {
+	b.mux.Lock()
+	if b.rtt == 0 {
+		b.rtt = d
+	} else {
+		b.rtt = (b.rtt*4 + d) / 5
+	}
+	b.mux.Unlock()
+}
+
+// resetRTT forgets the RTT estimate of a backend marked down, it may come back on another
+// path, and a stale low estimate would draw requests before it is measured again
+func (b *Server) resetRTT() {
+	b.mux.Lock()
+	b.rtt = 0
+	b.mux.Unlock()
+}
+
+// RTT returns the smoothed round trip time to this backend, 0 until it was measured
+func (b *Server) RTT() (rtt time.Duration) {
+	b.mux.RLock()
+	rtt = b.rtt
+	b.mux.RUnlock()
+	return
+}
+
+// connectTimed connects to the backend, giving up after timeout, and returns how long the
+// TCP handshake took. Its host is resolved before, name lookups are no part of the distance.
+func (b *Server) connectTimed(timeout time.Duration) (net.Conn, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	host, port, err := net.SplitHostPort(b.URL.Host)
+	if b.Egress() != nil || err != nil {
+		// the proxy resolves the host, and its handshake is not the backend's anyway
+		start := time.Now()
+		conn, err := b.dial(ctx, "tcp", b.URL.Host)
+		return conn, time.Since(start), err
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, addr := range addrs {
+		start := time.Now()
+		var conn net.Conn
+		if conn, err = b.dial(ctx, "tcp", net.JoinHostPort(addr, port)); err == nil {
+			return conn, time.Since(start), nil
+		}
+	}
+	return nil, 0, err
+}
+
+// proximityFilter keeps the servers whose RTT is within margin of the lowest RTT among
+// the servers still eligible. Servers not measured yet are only kept while no server is.
+func proximityFilter(margin time.Duration) Filter {
+	if margin == 0 {
+		margin = defaultProximityMargin
+	}
+	return Filter{
+		Name:   FilterProximity,
+		Prefer: true,
+		KeepAmong: func(pool *ServerPool, eligible []bool) []bool {
+			rtts := make([]time.Duration, len(pool.servers))
+			var lowest time.Duration
+			for i, server := range pool.servers {
+				if !eligible[i] {
+					continue
+				}
+				rtts[i] = server.RTT()
+				if rtts[i] > 0 && (lowest == 0 || rtts[i] < lowest) {
+					lowest = rtts[i]
+				}
+			}
+			kept := make([]bool, len(eligible))
+			for i := range kept {
+				kept[i] = eligible[i] && (lowest == 0 || (rtts[i] > 0 && rtts[i] <= lowest+margin))
+			}
+			return kept
+		},
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestProximityFilter(t *testing.T) {
+	pool := selectionPool("a", "b", "c")
+	for i, rtt := range []time.Duration{2 * time.Millisecond, 5 * time.Millisecond, 30 * time.Millisecond} {
+		pool.servers[i].recordRTT(rtt)
+	}
+	p, err := NewPipeline([]string{FilterProximity}, nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[*Server]bool{}
+	for range 4 {
+		server, _ := p.Select(pool)
+		seen[server] = true
+	}
+	if !seen[pool.servers[0]] || !seen[pool.servers[1]] || seen[pool.servers[2]] {
+		t.Fatalf("expected the servers within 5ms of the nearest, got %v", seen)
+	}
+
+	// an ejected server is measured anew before it competes again
+	ejectServer(pool.servers[0])
+	if rtt := pool.servers[0].RTT(); rtt != 0 {
+		t.Fatalf("expected the RTT to be forgotten, got %s", rtt)
+	}
+}
+
+func TestProximityMarginValidation(t *testing.T) {
+	cfg := &Config{
+		Pools:  map[string]*PoolConfig{"app": {Servers: []*ServerConfig{{URL: "http://127.0.0.1:1"}}}},
+		Routes: []*RouteConfig{{Prefix: "/", Pool: "app", Filters: []string{FilterProximity}, ProximityMargin: "-5ms"}},
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected a negative margin to be rejected")
+	}
+}
+
+func TestConnectTimedResolvesHostNames(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	u, _ := url.Parse("http://localhost:" + port)
+	conn, rtt, err := NewServer(u, "app").connectTimed(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if rtt <= 0 {
+		t.Fatalf("expected the handshake to be timed, got %s", rtt)
+	}
+}
+
+func TestNewServersAreMeasured(t *testing.T) {
+	for len(addedServers) > 0 {
+		<-addedServers
+	}
+	pool := func(servers ...string) *Config {
+		pc := &PoolConfig{}
+		for _, s := range servers {
+			pc.Servers = append(pc.Servers, &ServerConfig{URL: s})
+		}
+		return &Config{
+			Pools:  map[string]*PoolConfig{"app": pc},
+			Routes: []*RouteConfig{{Prefix: "/", Pool: "app"}},
+		}
+	}
+	defer routes.Store(nil)
+	if err := applyConfig(pool("http://127.0.0.1:1")); err != nil {
+		t.Fatal(err)
+	}
+	if added := <-addedServers; len(added) != 1 || added[0].URL.Host != "127.0.0.1:1" {
+		t.Fatalf("expected the first server to be queued, got %v", added)
+	}
+	if err := applyConfig(pool("http://127.0.0.1:1", "http://127.0.0.1:2")); err != nil {
+		t.Fatal(err)
+	}
+	if added := <-addedServers; len(added) != 1 || added[0].URL.Host != "127.0.0.1:2" {
+		t.Fatalf("expected only the added server to be queued, got %v", added)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+const maxInternalRedirects int = 3
+
+// internalRedirectWriter holds back the response of a backend until it is known whether
+// it is an internal redirect, which is discarded instead of being sent to the client
+type internalRedirectWriter struct {
+	http.ResponseWriter
+	header   http.Header
+	name     string
+	location string
+	passed   bool
+}
+
+func newInternalRedirectWriter(w http.ResponseWriter, name string) *internalRedirectWriter {
+	return &internalRedirectWriter{ResponseWriter: w, header: http.Header{}, name: name}
+}
+
+func (iw *internalRedirectWriter) Header() http.Header {
+	if iw.passed {
+		return iw.ResponseWriter.Header()
+	}
+	return iw.header
+}
+
+func (iw *internalRedirectWriter) WriteHeader(status int) {
+	if iw.passed || iw.location != "" {
+		if iw.passed {
+			iw.ResponseWriter.WriteHeader(status)
+		}
+		return
+	}
+	if status >= 200 {
+		if location := iw.header.Get(iw.name); location != "" {
+			iw.location = location
+			return
+		}
+		iw.passed = true
+	}
+	for key, values := range iw.header {
+		iw.ResponseWriter.Header()[key] = values
+	}
+	if status < 200 {
+		iw.header = http.Header{}
+	}
+	iw.ResponseWriter.WriteHeader(status)
+}
+
+func (iw *internalRedirectWriter) Write(p []byte) (int, error) {
+	if !iw.passed && iw.location == "" {
+		iw.WriteHeader(http.StatusOK)
+	}
+	if iw.location != "" {
+		// the body of a redirecting response is discarded
+		return len(p), nil
+	}
+	return iw.ResponseWriter.Write(p)
+}
+
+func (iw *internalRedirectWriter) Flush() {
+	if !iw.passed {
+		return
+	}
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (iw *internalRedirectWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+// internalRedirectChain returns the locations served for the request so far, the one the
+// client requested first
+func internalRedirectChain(r *http.Request) []string {
+	if chain, ok := r.Context().Value(InternalRedirectKey).([]string); ok {
+		return chain
+	}
+	return []string{r.URL.RequestURI()}
+}
+
+// GetInternalRedirectsFromContext returns how many internal redirects led to the request
+func GetInternalRedirectsFromContext(r *http.Request) int {
+	return len(internalRedirectChain(r)) - 1
+}
+
+// serveInternalRedirect serves the location a backend redirected to through the
+// routes, including internal ones, as a new GET (or HEAD) request with the client's headers
+func serveInternalRedirect(w http.ResponseWriter, r *http.Request, header http.Header, iw *internalRedirectWriter) {
+	chain := internalRedirectChain(r)
+	target, err := url.Parse(iw.location)
+	if err != nil || !strings.HasPrefix(target.Path, "/") || len(chain) > maxInternalRedirects {
+		log.Printf("%s(%s) Invalid internal redirect to %q\n", r.RemoteAddr, r.URL.Path, iw.location)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+	if slices.Contains(chain, target.RequestURI()) {
+		log.Printf("%s(%s) Internal redirect loop to %s\n", r.RemoteAddr, r.URL.Path, target)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+	log.Printf("%s(%s) Internal redirect to %s\n", r.RemoteAddr, r.URL.Path, target)
+
+	ctx := context.WithValue(r.Context(), InternalRedirectKey, append(slices.Clone(chain), target.RequestURI()))
+	ctx = context.WithValue(ctx, Attempts, 1)
+	ctx = context.WithValue(ctx, Retry, 0)
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+	req := r.Clone(ctx)
+	req.Method = method
+	req.URL.Path, req.URL.RawPath, req.URL.RawQuery = target.Path, target.RawPath, target.RawQuery
+	req.RequestURI = target.RequestURI()
+	req.Body, req.ContentLength = http.NoBody, 0
+	req.Header = header
+	req.Header.Del("Content-Length")
+	req.Header.Del("Content-Type")
+	if deadLetters != nil {
+		// a failed redirect is captured as the request it became, without the original body
+		req = req.WithContext(context.WithValue(req.Context(), DeadLetterKey, newDeadLetterRequest(req.Header, nil)))
+	}
+	if disposition := iw.header.Get("Content-Disposition"); disposition != "" {
+		// let the application name the download
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	lb(w, req)
+}
+
+// staticFS serves the files of a directory without listing directories
+type staticFS struct {
+	http.FileSystem
+}
+
+func (fs staticFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		index, err := fs.FileSystem.Open(strings.TrimSuffix(name, "/") + "/index.html")
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// NewStaticHandler serves the files in dir below the route prefix
+func NewStaticHandler(dir string, prefix string) http.Handler {
+	return http.StripPrefix(prefix, http.FileServer(staticFS{http.Dir(dir)}))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInternalRedirect(t *testing.T) {
+	defer func(b *Buffering) { buffering = b }(buffering)
+	buffering = &Buffering{Responses: true, Memory: 1 << 10, Limit: 1 << 10, Dir: t.TempDir()}
+	var hits []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.RequestURI())
+		switch {
+		case r.URL.Path == "/download":
+			w.Header().Set("X-Accel-Redirect", "/files/report?v=2")
+			w.Write([]byte("discarded"))
+		case r.URL.Path == "/files/report":
+			w.Write([]byte("report"))
+		case r.URL.Path == "/loop":
+			w.Header().Set("X-Accel-Redirect", "/loop/a")
+		case strings.HasPrefix(r.URL.Path, "/loop/"):
+			w.Header().Set("X-Accel-Redirect", "/loop")
+		default:
+			// every hop redirects further
+			w.Header().Set("X-Accel-Redirect", r.URL.Path+"/next")
+		}
+	}))
+	defer backend.Close()
+	applyConfig(&Config{
+		Pools:  map[string]*PoolConfig{"app": {Servers: []*ServerConfig{{URL: backend.URL}}}},
+		Routes: []*RouteConfig{{Prefix: "/", Pool: "app", InternalRedirect: "X-Accel-Redirect"}},
+	})
+	defer routes.Store(nil)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+		hits   []string
+	}{
+		{"/download", http.StatusOK, "report", []string{"/download", "/files/report?v=2"}},
+		{"/loop", http.StatusBadGateway, "Bad gateway\n", []string{"/loop", "/loop/a"}},
+		{"/far", http.StatusBadGateway, "Bad gateway\n", []string{"/far", "/far/next", "/far/next/next", "/far/next/next/next"}},
+	} {
+		hits = nil
+		w := httptest.NewRecorder()
+		lb(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.status || w.Body.String() != tc.body || w.Header().Get("X-Accel-Redirect") != "" {
+			t.Errorf("%s: expected %d %q, got %d %q with %v", tc.path, tc.status, tc.body, w.Code, w.Body, w.Header())
+		}
+		if strings.Join(hits, " ") != strings.Join(tc.hits, " ") {
+			t.Errorf("%s: expected the backend to serve %v, got %v", tc.path, tc.hits, hits)
+		}
+	}
+}
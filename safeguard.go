@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// MinHealthy returns the number of servers of the pool that have to stay in service,
+// the larger of its absolute and percentage minimum
+func (s *ServerPool) MinHealthy() int {
+	floor := int(math.Ceil(s.MinHealthyPercent / 100 * float64(len(s.servers))))
+	return max(floor, s.MinHealthyCount)
+}
+
+// InServiceCount returns the number of servers that are alive and not draining
+func (s *ServerPool) InServiceCount() int {
+	n := 0
+	for _, server := range s.servers {
+		if server.InService() {
+			n++
+		}
+	}
+	return n
+}
+
+// errBelowMinHealthy explains why an operation was refused
+func errBelowMinHealthy(pool *ServerPool, op string, remaining int) error {
+	return fmt.Errorf("%s would leave pool %s with %d servers in service, below its minimum of %d", op, pool.Name, remaining, pool.MinHealthy())
+}
+
+// checkMinHealthy refuses a new route table that takes servers out of a pool, or removes
+// the pool, while leaving it below its minimum. Replacing servers with new ones is allowed.
+func checkMinHealthy(old *RouteTable, table *RouteTable) error {
+	for name, oldPool := range old.Pools {
+		pool, ok := table.Pools[name]
+		if !ok {
+			if oldPool.MinHealthy() > 0 && oldPool.InServiceCount() > 0 {
+				return errBelowMinHealthy(oldPool, "removing the pool", 0)
+			}
+			continue
+		}
+		after := pool.InServiceCount()
+		if after < pool.MinHealthy() && after < oldPool.InServiceCount() {
+			return errBelowMinHealthy(pool, "config update", after)
+		}
+	}
+	return nil
+}
+
+// ejectServer marks a failing server down unless that would leave its pool below its minimum
+func ejectServer(server *Server) error {
+	if table := currentRoutes(); table != nil {
+		if pool, ok := table.Pools[server.pool]; ok {
+			// concurrent ejections must not all pass the check
+			pool.healthMux.Lock()
+			defer pool.healthMux.Unlock()
+			if server.InService() && pool.InServiceCount()-1 < pool.MinHealthy() {
+				return errBelowMinHealthy(pool, "ejecting "+redactURL(server.URL), pool.InServiceCount()-1)
+			}
+		}
+	}
+	server.SetAlive(false)
+	server.resetRTT()
+	return nil
+}
+
+// ServerState is the state of a server reported on the admin API
+type ServerState struct {
+	URL         string  `json:"url"`
+	Alive       bool    `json:"alive"`
+	Draining    bool    `json:"draining"`
+	Connections int     `json:"connections"`
+	RTTMs       float64 `json:"rtt_ms"`
+
+	CertDaysLeft *float64 `json:"cert_days_left,omitempty"`
+	CertError    string   `json:"cert_error,omitempty"`
+
+	// EgressFailures counts failures of the pool's egress proxy to reach the server
+	EgressFailures int64 `json:"egress_failures,omitempty"`
+}
+
+// PoolState is the state of a pool reported on the admin API
+type PoolState struct {
+	Algorithm  string        `json:"algorithm"`
+	InService  int           `json:"in_service"`
+	MinHealthy int           `json:"min_healthy"`
+	Servers    []ServerState `json:"servers"`
+}
+
+// serveServers reports the servers of every pool
+func serveServers(w http.ResponseWriter, r *http.Request) {
+	pools := map[string]PoolState{}
+	if table := currentRoutes(); table != nil {
+		for name, pool := range table.Pools {
+			state := PoolState{Algorithm: pool.Algorithm, InService: pool.InServiceCount(), MinHealthy: pool.MinHealthy()}
+			for _, server := range pool.servers {
+				server.mux.RLock()
+				state.Servers = append(state.Servers, ServerState{
+					URL:            redactURL(server.URL),
+					Alive:          server.Alive,
+					Draining:       server.draining,
+					Connections:    server.connections,
+					RTTMs:          milliseconds(server.rtt),
+					CertDaysLeft:   certDaysLeft(server.certExpires),
+					CertError:      server.certError,
+					EgressFailures: server.egressFailures,
+				})
+				server.mux.RUnlock()
+			}
+			pools[name] = state
+		}
+	}
+	writeJSON(w, http.StatusOK, pools)
+}
+
+// serveDrain drains (or with undrain=true puts back) the server given by the pool and
+// server query parameters. Drains that would leave the pool below its minimum are
+// refused with 409 unless force=true.
+func serveDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+		return
+	}
+	q := r.URL.Query()
+	undrain, _ := strconv.ParseBool(q.Get("undrain"))
+	force, _ := strconv.ParseBool(q.Get("force"))
+	table := currentRoutes()
+	if table == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no pools configured"})
+		return
+	}
+	pool, ok := table.Pools[q.Get("pool")]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown pool %q", q.Get("pool"))})
+		return
+	}
+	var server *Server
+	for _, s := range pool.servers {
+		if redactURL(s.URL) == q.Get("server") {
+			server = s
+		}
+	}
+	if server == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("pool %s has no server %q", pool.Name, q.Get("server"))})
+		return
+	}
+
+	configMux.Lock()
+	defer configMux.Unlock()
+	pool.healthMux.Lock()
+	defer pool.healthMux.Unlock()
+	if !undrain && server.InService() && pool.InServiceCount()-1 < pool.MinHealthy() {
+		err := errBelowMinHealthy(pool, "draining "+redactURL(server.URL), pool.InServiceCount()-1)
+		if !force {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error() + ", use force=true to drain anyway"})
+			return
+		}
+		log.Printf("Forced: %s\n", err)
+	}
+	server.SetDraining(!undrain)
+	log.Printf("%s (pool %s) draining: %t\n", redactURL(server.URL), pool.Name, !undrain)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"pool": pool.Name, "server": redactURL(server.URL), "draining": !undrain})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func safeguardConfig(pools ...string) *Config {
+	cfg := &Config{Pools: map[string]*PoolConfig{}}
+	for _, name := range pools {
+		cfg.Pools[name] = &PoolConfig{MinHealthy: 2, Servers: []*ServerConfig{
+			{URL: "http://127.0.0.1:1"}, {URL: "http://127.0.0.1:2"}, {URL: "http://127.0.0.1:3"}, {URL: "http://127.0.0.1:4"}}}
+		cfg.Routes = append(cfg.Routes, &RouteConfig{Prefix: "/" + name, Pool: name})
+	}
+	return cfg
+}
+
+func TestEjectServerConcurrent(t *testing.T) {
+	if err := applyConfig(safeguardConfig("api")); err != nil {
+		t.Fatal(err)
+	}
+	defer routes.Store(nil)
+	pool := currentRoutes().Pools["api"]
+
+	var wg sync.WaitGroup
+	for _, server := range pool.servers {
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ejectServer(server)
+			}()
+		}
+	}
+	wg.Wait()
+	if got := pool.InServiceCount(); got != 2 {
+		t.Fatalf("expected ejections to stop at the minimum of 2, got %d in service", got)
+	}
+}
+
+func TestCheckMinHealthyRemovedPool(t *testing.T) {
+	if err := applyConfig(safeguardConfig("api", "web")); err != nil {
+		t.Fatal(err)
+	}
+	defer routes.Store(nil)
+
+	if err := applyConfig(safeguardConfig("api")); err == nil {
+		t.Fatal("expected removing a pool with a minimum to be refused")
+	}
+	if currentRoutes().Pools["web"] == nil {
+		t.Fatal("expected the last good config to stay in effect")
+	}
+	cfg := safeguardConfig("api")
+	cfg.OverrideMinHealthy = true
+	if err := applyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FilterAlive         string = "alive"
+	FilterNotDraining   string = "not_draining"
+	FilterCircuitClosed string = "circuit_closed"
+	FilterLabels        string = "labels"
+	FilterSameZone      string = "same_zone"
+	FilterUnderLimit    string = "under_limit"
+	FilterProximity     string = "proximity"
+
+	circuitFailures int           = 5
+	circuitCooldown time.Duration = 30 * time.Second
+)
+
+// Filter is a stage of a selection pipeline, dropping servers a request must not be sent to
+type Filter struct {
+	Name string
+	Keep func(pool *ServerPool, server *Server) bool
+
+	// KeepAmong replaces Keep for filters comparing the eligible servers with each other
+	KeepAmong func(pool *ServerPool, eligible []bool) []bool
+
+	// Prefer passes all servers on when none of them qualify, instead of none
+	Prefer bool
+}
+
+// Pipeline selects a server by narrowing a pool down with filters, in order, and
+// picking one of the servers left with an algorithm
+type Pipeline struct {
+	Filters []Filter
+
+	// Algorithm picks among the servers left, the pool's algorithm when empty
+	Algorithm string
+}
+
+// defaultPipeline sends requests to servers in service with the pool's algorithm
+var defaultPipeline = &Pipeline{Filters: []Filter{
+	{Name: FilterAlive, Keep: func(pool *ServerPool, server *Server) bool { return server.IsAlive() }},
+	{Name: FilterNotDraining, Keep: func(pool *ServerPool, server *Server) bool { return !server.IsDraining() }},
+}}
+
+// NewPipeline builds a pipeline from filter names, labels are required by the labels filter
+// and margin is the proximity filter's, the default when 0. The alive and not_draining
+// filters always come first, whether they are listed or not.
+func NewPipeline(filters []string, labels map[string]string, margin time.Duration, algorithm string) (*Pipeline, error) {
+	p := &Pipeline{Algorithm: algorithm, Filters: slices.Clone(defaultPipeline.Filters)}
+	for _, name := range filters {
+		f := Filter{Name: name}
+		switch name {
+		case FilterAlive, FilterNotDraining:
+			continue
+		case FilterCircuitClosed:
+			f.Keep = func(pool *ServerPool, server *Server) bool { return server.CircuitClosed() }
+		case FilterLabels:
+			if len(labels) == 0 {
+				return nil, fmt.Errorf("filter %s requires labels", name)
+			}
+			f.Keep = func(pool *ServerPool, server *Server) bool { return server.HasLabels(labels) }
+		case FilterSameZone:
+			// servers in other zones are still used when none is left in ours
+			f.Prefer = true
+			f.Keep = func(pool *ServerPool, server *Server) bool { return zone == "" || server.Zone() == zone }
+		case FilterProximity:
+			f = proximityFilter(margin)
+		case FilterUnderLimit:
+			f.Keep = func(pool *ServerPool, server *Server) bool {
+				return pool.MaxConnections <= 0 || server.Connections() < pool.MaxConnections
+			}
+		default:
+			return nil, fmt.Errorf("unknown filter %q", name)
+		}
+		p.Filters = append(p.Filters, f)
+	}
+	switch algorithm {
+	case "", RoundRobin, LeastConnection, WeightedRoundRobin, LeastCost:
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q", algorithm)
+	}
+	if len(p.Filters) == len(defaultPipeline.Filters) && algorithm == "" {
+		return defaultPipeline, nil
+	}
+	return p, nil
+}
+
+// StageResult is the number of servers a stage of a pipeline was given and kept
+type StageResult struct {
+	Stage string
+	In    int
+	Out   int
+}
+
+// SelectionError explains stage by stage why no server qualified for a request
+type SelectionError struct {
+	Pool   string
+	Stages []StageResult
+}
+
+func (e *SelectionError) Error() string {
+	var stages []string
+	for _, stage := range e.Stages {
+		stages = append(stages, fmt.Sprintf("%s kept %d of %d", stage.Stage, stage.Out, stage.In))
+	}
+	if len(stages) == 0 {
+		return fmt.Sprintf("no server qualifies in pool %s, it has no servers", e.Pool)
+	}
+	return fmt.Sprintf("no server qualifies in pool %s: %s", e.Pool, strings.Join(stages, ", "))
+}
+
+// Select runs the pipeline on the pool, returning a SelectionError when no server qualifies
+func (p *Pipeline) Select(pool *ServerPool) (*Server, error) {
+	eligible := make([]bool, len(pool.servers))
+	left := len(pool.servers)
+	for i := range eligible {
+		eligible[i] = true
+	}
+	err := &SelectionError{Pool: pool.Name}
+	for _, f := range p.Filters {
+		if left == 0 {
+			break
+		}
+		var kept []bool
+		if f.KeepAmong != nil {
+			kept = f.KeepAmong(pool, eligible)
+		} else {
+			kept = make([]bool, len(eligible))
+			for i, server := range pool.servers {
+				kept[i] = eligible[i] && f.Keep(pool, server)
+			}
+		}
+		n := 0
+		for _, ok := range kept {
+			if ok {
+				n++
+			}
+		}
+		err.Stages = append(err.Stages, StageResult{Stage: f.Name, In: left, Out: n})
+		if n == 0 && f.Prefer {
+			continue
+		}
+		eligible, left = kept, n
+	}
+	if left == 0 {
+		return nil, err
+	}
+
+	algorithm := p.Algorithm
+	if algorithm == "" {
+		algorithm = pool.Algorithm
+	}
+	var server *Server
+	switch algorithm {
+	case LeastConnection:
+		server = pool.pickLeastConnection(eligible)
+	case WeightedRoundRobin:
+		server = pool.pickWeightedRoundRobin(eligible)
+	case LeastCost:
+		server = pool.pickLeastCost(eligible)
+	default:
+		server = pool.pickRoundRobin(eligible)
+	}
+	return server, nil
+}
+
+// inService returns which servers of the pool are alive and not draining
+func (s *ServerPool) inService() []bool {
+	eligible := make([]bool, len(s.servers))
+	for i, server := range s.servers {
+		eligible[i] = server.InService()
+	}
+	return eligible
+}
+
+// GetNextServerRoundRobin returns the next server in service in round robin fashion
+func (s *ServerPool) GetNextServerRoundRobin() *Server {
+	if len(s.servers) == 0 {
+		return nil
+	}
+	return s.pickRoundRobin(s.inService())
+}
+
+// GetNextServerWeightedRoundRobin returns the next server in service in smooth weighted round robin fashion
+func (s *ServerPool) GetNextServerWeightedRoundRobin() *Server {
+	return s.pickWeightedRoundRobin(s.inService())
+}
+
+// GetNextServerLeastConnection returns the server in service with the fewest requests in flight
+func (s *ServerPool) GetNextServerLeastConnection() *Server {
+	return s.pickLeastConnection(s.inService())
+}
+
+// GetNextServerLeastCost returns the server in service with the least outstanding request cost
+func (s *ServerPool) GetNextServerLeastCost() *Server {
+	return s.pickLeastCost(s.inService())
+}
+
+// pickRoundRobin returns the next eligible server in round robin fashion
+func (s *ServerPool) pickRoundRobin(eligible []bool) *Server {
+	next := s.NextIndex()
+	l := len(s.servers) + next
+	for i := next; i < l; i++ {
+		idx := i % len(s.servers)
+		if eligible[idx] {
+			if i != next {
+				atomic.StoreUint64(&s.current, uint64(idx))
+			}
+			return s.servers[idx]
+		}
+	}
+	return nil
+}
+
+// pickWeightedRoundRobin returns the next eligible server in smooth weighted round robin fashion
+func (s *ServerPool) pickWeightedRoundRobin(eligible []bool) *Server {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var best *Server
+	total := 0
+	for i, server := range s.servers {
+		if !eligible[i] {
+			continue
+		}
+		server.mux.Lock()
+		server.current += server.weight
+		total += server.weight
+		if best == nil || server.current > best.current {
+			best = server
+		}
+		server.mux.Unlock()
+	}
+	if best != nil {
+		best.mux.Lock()
+		best.current -= total
+		best.mux.Unlock()
+	}
+	return best
+}
+
+// pickLeastConnection returns the eligible server with the fewest requests in flight
+func (s *ServerPool) pickLeastConnection(eligible []bool) *Server {
+	var best *Server
+	bestConnections := 0
+	for i, server := range s.servers {
+		if !eligible[i] {
+			continue
+		}
+		if connections := server.Connections(); best == nil || connections < bestConnections {
+			best, bestConnections = server, connections
+		}
+	}
+	return best
+}
+
+// pickLeastCost returns the eligible server with the least outstanding request cost
+func (s *ServerPool) pickLeastCost(eligible []bool) *Server {
+	var best *Server
+	bestCost := 0.0
+	for i, server := range s.servers {
+		if !eligible[i] {
+			continue
+		}
+		if cost := server.OutstandingCost(); best == nil || cost < bestCost {
+			best, bestCost = server, cost
+		}
+	}
+	return best
+}
+
+// CircuitClosed returns false while the backend's circuit is open after consecutive
+// failures. Once the cooldown has passed requests are let through again, and the
+// next failure opens the circuit again until a request succeeds.
+func (b *Server) CircuitClosed() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return time.Now().After(b.circuitOpenUntil)
+}
+
+// countSuccess closes the circuit of the backend
+func (b *Server) countSuccess() {
+	b.mux.Lock()
+	b.consecutiveFailures = 0
+	b.mux.Unlock()
+}
+
+// SetPlacement sets the zone and labels of the backend
+func (b *Server) SetPlacement(zone string, labels map[string]string) {
+	b.mux.Lock()
+	b.zone, b.labels = zone, labels
+	b.mux.Unlock()
+}
+
+// Zone returns the zone of the backend
+func (b *Server) Zone() (zone string) {
+	b.mux.RLock()
+	zone = b.zone
+	b.mux.RUnlock()
+	return
+}
+
+// HasLabels returns true when the backend has all the labels with the same values
+func (b *Server) HasLabels(labels map[string]string) bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	for key, value := range labels {
+		if v, ok := b.labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
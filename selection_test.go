@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+// selectionPool returns a pool of servers with the given tiers, in order
+func selectionPool(tiers ...string) *ServerPool {
+	pool := &ServerPool{Name: "app"}
+	for i, tier := range tiers {
+		server := NewServer(&url.URL{Scheme: "http", Host: "10.0.0." + string(rune('1'+i)) + ":8080"}, "app")
+		server.SetPlacement("", map[string]string{"tier": tier})
+		pool.AddServer(server)
+	}
+	return pool
+}
+
+func TestPipelineSelect(t *testing.T) {
+	pool := selectionPool("gold", "gold", "gold", "silver")
+	pool.servers[0].SetAlive(false)
+	pool.servers[1].SetDraining(true)
+
+	// alive and not_draining apply even when not listed
+	p, err := NewPipeline([]string{FilterLabels}, map[string]string{"tier": "gold"}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if server, err := p.Select(pool); err != nil || server != pool.servers[2] {
+			t.Fatalf("expected the only gold server in service, got %v, error %v", server, err)
+		}
+	}
+
+	pool.servers[2].SetAlive(false)
+	_, err = p.Select(pool)
+	var selErr *SelectionError
+	if !errors.As(err, &selErr) {
+		t.Fatalf("expected a selection error, got %v", err)
+	}
+	expected := []StageResult{{FilterAlive, 4, 2}, {FilterNotDraining, 2, 1}, {FilterLabels, 1, 0}}
+	if len(selErr.Stages) != len(expected) {
+		t.Fatalf("expected stages %v, got %v", expected, selErr.Stages)
+	}
+	for i, stage := range expected {
+		if selErr.Stages[i] != stage {
+			t.Fatalf("expected stages %v, got %v", expected, selErr.Stages)
+		}
+	}
+}
+
+func TestPipelineSelectPrefer(t *testing.T) {
+	defer func(z string) { zone = z }(zone)
+	zone = "eu-1a"
+	pool := selectionPool("gold", "gold")
+	pool.servers[0].SetPlacement("eu-1b", nil)
+	pool.servers[1].SetPlacement("eu-1a", nil)
+
+	p, err := NewPipeline([]string{FilterSameZone}, nil, 0, LeastConnection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server, _ := p.Select(pool); server != pool.servers[1] {
+		t.Fatalf("expected the server in our zone, got %v", server)
+	}
+	pool.servers[1].SetAlive(false)
+	if server, _ := p.Select(pool); server != pool.servers[0] {
+		t.Fatalf("expected the other zone once ours has no server left, got %v", server)
+	}
+}
+
+func TestGetNextServerRoundRobin(t *testing.T) {
+	pool := selectionPool("a", "b", "c")
+	pool.servers[1].SetDraining(true)
+	seen := map[*Server]int{}
+	for range 6 {
+		seen[pool.GetNextServerRoundRobin()]++
+	}
+	if seen[pool.servers[0]] != 3 || seen[pool.servers[2]] != 3 {
+		t.Fatalf("expected the servers in service to alternate, got %v", seen)
+	}
+	if (&ServerPool{}).GetNextServerRoundRobin() != nil {
+		t.Fatal("expected no server from an empty pool")
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	socksSucceeded       byte = 0
+	socksGeneralFailure  byte = 1
+	socksNotAllowed      byte = 2
+	socksHostUnreachable byte = 4
+	socksNotSupported    byte = 7
+)
+
+// socksGatewayPool is the pool of the SOCKS5 proxy's egress gateways, whose servers are
+// checked to be egress proxy URLs on every config update, empty without the proxy
+var socksGatewayPool string
+
+// socksRule allows destinations by host, *. wildcard or network, optionally on one port only
+type socksRule struct {
+	host    string
+	network *net.IPNet
+	port    string
+}
+
+// SOCKSProxy is a SOCKS5 server sending the connections of its clients out through the
+// egress gateways of a pool, e.g. socks5://gw1:1080 or http://gw2:3128
+type SOCKSProxy struct {
+	Pool       string
+	MaxPerUser int
+
+	users map[string]string
+	allow []socksRule
+	mux   sync.Mutex
+	conns map[string]int
+}
+
+// NewSOCKSProxy creates a SOCKS5 server for the gateways of pool. usersFile holds a user:password
+// per line and enables authentication, allow is a comma separated list of destinations like
+// *.example.com:443 or 10.0.0.0/8, empty to allow all. Without either it would be an open
+// relay, and an error is returned.
+func NewSOCKSProxy(pool string, usersFile string, allow string, maxPerUser int) (*SOCKSProxy, error) {
+	s := &SOCKSProxy{Pool: pool, MaxPerUser: maxPerUser, conns: map[string]int{}}
+	if usersFile != "" {
+		data, err := os.ReadFile(usersFile)
+		if err != nil {
+			return nil, err
+		}
+		s.users = map[string]string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, password, ok := strings.Cut(line, ":")
+			if !ok || user == "" || len(user) > 255 || len(password) > 255 {
+				return nil, fmt.Errorf("%s: malformed user %q", usersFile, user)
+			}
+			s.users[user] = password
+		}
+	}
+	for _, tok := range strings.Split(allow, ",") {
+		if tok = strings.TrimSpace(tok); tok == "" {
+			continue
+		}
+		rule := socksRule{host: tok}
+		if host, port, err := net.SplitHostPort(tok); err == nil {
+			rule.host, rule.port = host, port
+		}
+		if strings.Contains(rule.host, "/") {
+			_, network, err := net.ParseCIDR(rule.host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid destination %q: %v", tok, err)
+			}
+			rule.network = network
+		}
+		s.allow = append(s.allow, rule)
+	}
+	if s.users == nil && len(s.allow) == 0 {
+		return nil, errors.New("the SOCKS5 proxy requires users or allowed destinations, it would be an open relay")
+	}
+	return s, nil
+}
+
+// Allowed returns true when the allow-list admits the destination host:port
+func (s *SOCKSProxy) Allowed(dest string) bool {
+	if len(s.allow) == 0 {
+		return true
+	}
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, rule := range s.allow {
+		if rule.port != "" && rule.port != port {
+			continue
+		}
+		switch {
+		case rule.network != nil:
+			if ip != nil && rule.network.Contains(ip) {
+				return true
+			}
+		case ip != nil:
+			if ruleIP := net.ParseIP(rule.host); ruleIP != nil && ruleIP.Equal(ip) {
+				return true
+			}
+		case matchHost(rule.host, strings.TrimSuffix(host, ".")):
+			return true
+		}
+	}
+	return false
+}
+
+// acquire counts a connection of user, returning false when the user is at its limit
+func (s *SOCKSProxy) acquire(user string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.MaxPerUser > 0 && s.conns[user] >= s.MaxPerUser {
+		return false
+	}
+	s.conns[user]++
+	return true
+}
+
+func (s *SOCKSProxy) release(user string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.conns[user]--; s.conns[user] <= 0 {
+		delete(s.conns, user)
+	}
+}
+
+// Serve accepts SOCKS5 clients on port
+func (s *SOCKSProxy) Serve(port int) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("SOCKS5 proxy started at :%d\n", port)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("SOCKS5 accept failed, error: ", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !overload.Admit() {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer overload.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// socksReply answers the client's CONNECT request
+func socksReply(conn net.Conn, code byte) {
+	conn.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+}
+
+// authenticate negotiates the authentication method and returns the user, the client's
+// IP address for anonymous clients
+func (s *SOCKSProxy) authenticate(conn net.Conn, r *bufio.Reader) (string, error) {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(r, greeting); err != nil {
+		return "", err
+	}
+	if greeting[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", greeting[0])
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+	want := socksNoAuth
+	if s.users != nil {
+		want = socksUserPass
+	}
+	if !strings.Contains(string(methods), string([]byte{want})) {
+		conn.Write([]byte{socksVersion, socksNoMethods})
+		return "", errors.New("no acceptable authentication method")
+	}
+	conn.Write([]byte{socksVersion, want})
+	if s.users == nil {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		return host, nil
+	}
+
+	// username/password subnegotiation, RFC 1929
+	readField := func() (string, error) {
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		field := make([]byte, n)
+		_, err = io.ReadFull(r, field)
+		return string(field), err
+	}
+	if _, err := r.ReadByte(); err != nil {
+		return "", err
+	}
+	user, err := readField()
+	if err != nil {
+		return "", err
+	}
+	password, err := readField()
+	if err != nil {
+		return "", err
+	}
+	expected, ok := s.users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		conn.Write([]byte{1, 1})
+		return "", fmt.Errorf("authentication failed for user %q", user)
+	}
+	conn.Write([]byte{1, 0})
+	return user, nil
+}
+
+// handle authenticates a client, checks its destination and relays its connection
+// through an egress gateway
+func (s *SOCKSProxy) handle(client net.Conn) {
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(client)
+	user, err := s.authenticate(client, r)
+	if err != nil {
+		log.Printf("%s SOCKS5 rejected, error: %s\n", client.RemoteAddr(), err)
+		return
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	dest, err := readSocksAddr(r, header[3])
+	if err != nil {
+		log.Printf("%s SOCKS5 malformed request, error: %s\n", client.RemoteAddr(), err)
+		return
+	}
+	if header[1] != socksConnect {
+		socksReply(client, socksNotSupported)
+		return
+	}
+	client.SetReadDeadline(time.Time{})
+
+	if !s.Allowed(dest) {
+		log.Printf("%s SOCKS5 %s to %s not allowed\n", client.RemoteAddr(), user, dest)
+		socksReply(client, socksNotAllowed)
+		return
+	}
+	if !s.acquire(user) {
+		log.Printf("%s SOCKS5 %s at its limit of %d connections\n", client.RemoteAddr(), user, s.MaxPerUser)
+		socksReply(client, socksNotAllowed)
+		return
+	}
+	defer s.release(user)
+
+	upstream, gateway, code := s.dial(dest)
+	if upstream == nil {
+		socksReply(client, code)
+		return
+	}
+	defer upstream.Close()
+	gateway.addConnection(1)
+	defer gateway.removeConnection(1)
+	socksReply(client, socksSucceeded)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, r)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// dial connects to dest through a gateway of the pool, trying others when gateways fail,
+// and returns the SOCKS5 reply code when no connection could be made
+func (s *SOCKSProxy) dial(dest string) (net.Conn, *Server, byte) {
+	var pool *ServerPool
+	if table := currentRoutes(); table != nil {
+		pool = table.Pools[s.Pool]
+	}
+	if pool == nil {
+		log.Printf("SOCKS5 pool %s does not exist\n", s.Pool)
+		return nil, nil, socksGeneralFailure
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		gateway := pool.GetNextServer()
+		if gateway == nil {
+			log.Println("SOCKS5 no egress gateway available")
+			return nil, nil, socksGeneralFailure
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		conn, err := (&EgressProxy{URL: gateway.URL}).DialContext(ctx, "tcp", dest)
+		cancel()
+		if err == nil {
+			return conn, gateway, socksSucceeded
+		}
+		log.Printf("[%s] %s\n", gateway.URL.Host, err)
+		if !isEgressError(err) {
+			// the gateway is fine, the destination is not reachable
+			return nil, nil, socksHostUnreachable
+		}
+		// health checks take the gateway out of rotation if it keeps failing
+		gateway.countFailure()
+	}
+	return nil, nil, socksGeneralFailure
+}
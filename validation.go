@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ValidationEnforce string = "enforce"
+	ValidationReport  string = "report"
+)
+
+// openAPIMaxBody is the largest request body validated, in bytes, larger bodies are
+// passed on without checking them against their schema
+var openAPIMaxBody int64 = 1 << 20
+
+// OpenAPI holds the subset of an OpenAPI 3 document used to validate requests
+type OpenAPI struct {
+	Servers    []struct{ URL string } `json:"servers"`
+	Paths      map[string]*PathItem   `json:"paths"`
+	Components struct {
+		Schemas       map[string]*Schema      `json:"schemas"`
+		Parameters    map[string]*Parameter   `json:"parameters"`
+		RequestBodies map[string]*RequestBody `json:"requestBodies"`
+	} `json:"components"`
+}
+
+// PathItem describes the operations available on a single path
+type PathItem struct {
+	Parameters []*Parameter `json:"parameters"`
+	Get        *Operation   `json:"get"`
+	Put        *Operation   `json:"put"`
+	Post       *Operation   `json:"post"`
+	Delete     *Operation   `json:"delete"`
+	Options    *Operation   `json:"options"`
+	Head       *Operation   `json:"head"`
+	Patch      *Operation   `json:"patch"`
+	Trace      *Operation   `json:"trace"`
+}
+
+// Operation describes a single API operation on a path
+type Operation struct {
+	Parameters  []*Parameter `json:"parameters"`
+	RequestBody *RequestBody `json:"requestBody"`
+}
+
+// Parameter describes a path, query or header parameter
+type Parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+// RequestBody describes the accepted request bodies of an operation
+type RequestBody struct {
+	Ref      string `json:"$ref"`
+	Required bool   `json:"required"`
+	Content  map[string]struct {
+		Schema *Schema `json:"schema"`
+	} `json:"content"`
+}
+
+// Schema is the subset of JSON schema supported by the validator
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Nullable             bool               `json:"nullable"`
+	Enum                 []interface{}      `json:"enum"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"-"`
+	Items                *Schema            `json:"items"`
+	AllOf                []*Schema          `json:"allOf"`
+	AnyOf                []*Schema          `json:"anyOf"`
+	OneOf                []*Schema          `json:"oneOf"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	Pattern              string             `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+// UnmarshalJSON accepts additionalProperties as either a boolean or a schema
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	type plain Schema
+	var raw struct {
+		plain
+		AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*s = Schema(raw.plain)
+	var allowed bool
+	if err := json.Unmarshal(raw.AdditionalProperties, &allowed); err == nil {
+		s.AdditionalProperties = &allowed
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	return nil
+}
+
+// Violation describes a single way in which a request does not match its spec
+type Violation struct {
+	In      string `json:"in"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	if v.Name == "" {
+		return fmt.Sprintf("%s: %s", v.In, v.Message)
+	}
+	return fmt.Sprintf("%s %q: %s", v.In, v.Name, v.Message)
+}
+
+// specRoute is a path template of a loaded document
+type specRoute struct {
+	doc      *OpenAPI
+	item     *PathItem
+	template string
+	segments []string
+	literals int
+}
+
+// match returns the path parameters when the escaped path matches the route template
+func (sr *specRoute) match(path string) (map[string]string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != len(sr.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, seg := range sr.segments {
+		value, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return nil, false
+		}
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if value == "" {
+				return nil, false
+			}
+			params[seg[1:len(seg)-1]] = value
+			continue
+		}
+		if seg != value {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// RequestValidator validates requests against one or more OpenAPI documents
+type RequestValidator struct {
+	routes []*specRoute
+	mode   string
+
+	// MaxBody is the largest request body validated, openAPIMaxBody unless set
+	MaxBody int64
+}
+
+// NewRequestValidator loads the comma separated list of OpenAPI JSON documents
+func NewRequestValidator(files string, mode string) (*RequestValidator, error) {
+	if mode != ValidationEnforce && mode != ValidationReport {
+		return nil, fmt.Errorf("unknown validation mode %q", mode)
+	}
+	v := &RequestValidator{mode: mode, MaxBody: openAPIMaxBody}
+	for _, file := range strings.Split(files, ",") {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		doc := &OpenAPI{}
+		if err := json.Unmarshal(data, doc); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		base := ""
+		if len(doc.Servers) > 0 {
+			if u, err := url.Parse(doc.Servers[0].URL); err == nil {
+				base = strings.TrimSuffix(u.Path, "/")
+			}
+		}
+		for template, item := range doc.Paths {
+			full := base + template
+			sr := &specRoute{doc: doc, item: item, template: full}
+			sr.segments = strings.Split(strings.Trim(full, "/"), "/")
+			for _, seg := range sr.segments {
+				if !strings.HasPrefix(seg, "{") {
+					sr.literals++
+				}
+			}
+			v.routes = append(v.routes, sr)
+		}
+		log.Printf("Loaded OpenAPI document %s (%d paths)\n", file, len(doc.Paths))
+	}
+	return v, nil
+}
+
+// route returns the most specific route matching path
+func (v *RequestValidator) route(path string) (*specRoute, map[string]string) {
+	var best *specRoute
+	var bestParams map[string]string
+	for _, sr := range v.routes {
+		params, ok := sr.match(path)
+		if !ok {
+			continue
+		}
+		if best == nil || sr.literals > best.literals {
+			best, bestParams = sr, params
+		}
+	}
+	return best, bestParams
+}
+
+// Validate checks r against its matching operation. Requests whose path is not
+// described by any document are not validated.
+func (v *RequestValidator) Validate(r *http.Request) []Violation {
+	sr, pathParams := v.route(r.URL.EscapedPath())
+	if sr == nil {
+		return nil
+	}
+	op := sr.item.operation(r.Method)
+	if op == nil {
+		return []Violation{{In: "method", Name: r.Method, Message: "operation not defined for " + sr.template}}
+	}
+
+	var violations []Violation
+	params := map[string]*Parameter{}
+	for _, p := range append(append([]*Parameter{}, sr.item.Parameters...), op.Parameters...) {
+		p = sr.doc.parameter(p)
+		if p != nil {
+			params[p.In+":"+p.Name] = p
+		}
+	}
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	query := r.URL.Query()
+	for _, key := range keys {
+		p := params[key]
+		var values []string
+		switch p.In {
+		case "path":
+			if value, ok := pathParams[p.Name]; ok {
+				values = []string{value}
+			}
+		case "query":
+			values = query[p.Name]
+		case "header":
+			values = r.Header.Values(p.Name)
+		default:
+			continue
+		}
+		if len(values) == 0 {
+			if p.Required || p.In == "path" {
+				violations = append(violations, Violation{In: p.In, Name: p.Name, Message: "required parameter is missing"})
+			}
+			continue
+		}
+		for _, msg := range sr.doc.validateParameter(p.Schema, values) {
+			violations = append(violations, Violation{In: p.In, Name: p.Name, Message: strings.TrimPrefix(msg, "/: ")})
+		}
+	}
+
+	if op.RequestBody != nil {
+		violations = append(violations, sr.doc.validateBody(sr.doc.requestBody(op.RequestBody), r, v.MaxBody)...)
+	}
+	return violations
+}
+
+// Check validates r, logging violations, and returns false after rejecting the request
+// with a 400 in enforce mode
+func (v *RequestValidator) Check(w http.ResponseWriter, r *http.Request) bool {
+	violations := v.Validate(r)
+	if len(violations) == 0 {
+		return true
+	}
+	for _, violation := range violations {
+		log.Printf("%s(%s) OpenAPI violation: %s\n", r.RemoteAddr, r.URL.Path, violation)
+	}
+	if v.mode == ValidationReport {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(struct {
+		Error      string      `json:"error"`
+		Violations []Violation `json:"violations"`
+	}{"request validation failed", violations})
+	return false
+}
+
+// Middleware validates requests before passing them on to next
+func (v *RequestValidator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v.Check(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// operation returns the operation for method, or nil when it is not defined
+func (p *PathItem) operation(method string) *Operation {
+	switch method {
+	case http.MethodGet:
+		return p.Get
+	case http.MethodPut:
+		return p.Put
+	case http.MethodPost:
+		return p.Post
+	case http.MethodDelete:
+		return p.Delete
+	case http.MethodOptions:
+		return p.Options
+	case http.MethodHead:
+		if p.Head == nil {
+			return p.Get
+		}
+		return p.Head
+	case http.MethodPatch:
+		return p.Patch
+	case http.MethodTrace:
+		return p.Trace
+	}
+	return nil
+}
+
+// refName returns the component name referenced by ref within section
+func refName(ref string, section string) string {
+	return strings.TrimPrefix(ref, "#/components/"+section+"/")
+}
+
+func (d *OpenAPI) parameter(p *Parameter) *Parameter {
+	if p != nil && p.Ref != "" {
+		return d.Components.Parameters[refName(p.Ref, "parameters")]
+	}
+	return p
+}
+
+func (d *OpenAPI) requestBody(b *RequestBody) *RequestBody {
+	if b != nil && b.Ref != "" {
+		return d.Components.RequestBodies[refName(b.Ref, "requestBodies")]
+	}
+	return b
+}
+
+func (d *OpenAPI) schema(s *Schema) *Schema {
+	for depth := 0; s != nil && s.Ref != "" && depth < 32; depth++ {
+		s = d.Components.Schemas[refName(s.Ref, "schemas")]
+	}
+	return s
+}
+
+// validateParameter converts the raw parameter values to the schema type and validates them
+func (d *OpenAPI) validateParameter(s *Schema, values []string) []string {
+	s = d.schema(s)
+	if s == nil {
+		return nil
+	}
+	if s.Type == "array" {
+		if len(values) == 1 {
+			values = strings.Split(values[0], ",")
+		}
+		items := make([]interface{}, 0, len(values))
+		for _, value := range values {
+			items = append(items, coerceParameter(d.schema(s.Items), value))
+		}
+		return d.validateValue(s, items, "")
+	}
+	return d.validateValue(s, coerceParameter(s, values[0]), "")
+}
+
+// coerceParameter converts a raw parameter string into the type its schema expects
+func coerceParameter(s *Schema, value string) interface{} {
+	if s == nil {
+		return value
+	}
+	switch s.Type {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// validateBody reads and validates a JSON request body, leaving it readable for the proxy.
+// Bodies over maxBody are only checked for their media type.
+func (d *OpenAPI) validateBody(body *RequestBody, r *http.Request, maxBody int64) []Violation {
+	if body == nil {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+	if err != nil {
+		return []Violation{{In: "body", Message: err.Error()}}
+	}
+	if len(data) == 0 {
+		if body.Required {
+			return []Violation{{In: "body", Message: "request body is required"}}
+		}
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	content, ok := body.Content[mediaType]
+	if !ok {
+		if _, any := body.Content["*/*"]; !any {
+			return []Violation{{In: "header", Name: "Content-Type", Message: fmt.Sprintf("unsupported media type %q", mediaType)}}
+		}
+		return nil
+	}
+	if content.Schema == nil || !(mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+	if int64(len(data)) > maxBody {
+		// too large to hold in memory for validation, the backend has to check it
+		return nil
+	}
+
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return []Violation{{In: "body", Message: "invalid JSON: " + err.Error()}}
+	}
+	var violations []Violation
+	for _, msg := range d.validateValue(content.Schema, value, "") {
+		violations = append(violations, Violation{In: "body", Message: msg})
+	}
+	return violations
+}
+
+// validateValue validates a decoded JSON value against s, returning messages prefixed by JSON pointer
+func (d *OpenAPI) validateValue(s *Schema, value interface{}, pointer string) []string {
+	s = d.schema(s)
+	if s == nil {
+		return nil
+	}
+	fail := func(format string, args ...interface{}) []string {
+		at := pointer
+		if at == "" {
+			at = "/"
+		}
+		return []string{at + ": " + fmt.Sprintf(format, args...)}
+	}
+
+	var errs []string
+	for _, sub := range s.AllOf {
+		errs = append(errs, d.validateValue(sub, value, pointer)...)
+	}
+	if len(s.AnyOf) > 0 && d.countMatches(s.AnyOf, value, pointer) == 0 {
+		errs = append(errs, fail("does not match any allowed schema")...)
+	}
+	if len(s.OneOf) > 0 && d.countMatches(s.OneOf, value, pointer) != 1 {
+		errs = append(errs, fail("must match exactly one allowed schema")...)
+	}
+
+	if value == nil {
+		if s.Nullable || s.Type == "" {
+			return errs
+		}
+		return append(errs, fail("must not be null")...)
+	}
+	if len(s.Enum) > 0 && !inEnum(s.Enum, value) {
+		errs = append(errs, fail("must be one of %v", s.Enum)...)
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return append(errs, fail("must be an object")...)
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, fail("missing required property %q", name)...)
+			}
+		}
+		for name, v := range obj {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					errs = append(errs, fail("unexpected property %q", name)...)
+				}
+				continue
+			}
+			errs = append(errs, d.validateValue(prop, v, pointer+"/"+name)...)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return append(errs, fail("must be an array")...)
+		}
+		if s.MinItems != nil && len(items) < *s.MinItems {
+			errs = append(errs, fail("must have at least %d items", *s.MinItems)...)
+		}
+		if s.MaxItems != nil && len(items) > *s.MaxItems {
+			errs = append(errs, fail("must have at most %d items", *s.MaxItems)...)
+		}
+		for i, item := range items {
+			errs = append(errs, d.validateValue(s.Items, item, pointer+"/"+strconv.Itoa(i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return append(errs, fail("must be a string")...)
+		}
+		length := len([]rune(str))
+		if s.MinLength != nil && length < *s.MinLength {
+			errs = append(errs, fail("must be at least %d characters", *s.MinLength)...)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			errs = append(errs, fail("must be at most %d characters", *s.MaxLength)...)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			errs = append(errs, fail("must match pattern %q", s.Pattern)...)
+		}
+	case "integer", "number":
+		num, ok := value.(json.Number)
+		if !ok {
+			return append(errs, fail("must be of type %s", s.Type)...)
+		}
+		f, err := num.Float64()
+		if err != nil || (s.Type == "integer" && f != math.Trunc(f)) {
+			return append(errs, fail("must be of type %s", s.Type)...)
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			errs = append(errs, fail("must be >= %v", *s.Minimum)...)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			errs = append(errs, fail("must be <= %v", *s.Maximum)...)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fail("must be a boolean")...)
+		}
+	}
+	return errs
+}
+
+// countMatches returns how many of schemas value validates against
+func (d *OpenAPI) countMatches(schemas []*Schema, value interface{}, pointer string) int {
+	n := 0
+	for _, sub := range schemas {
+		if len(d.validateValue(sub, value, pointer)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// inEnum reports whether value equals one of the enum entries
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSpec(t *testing.T, spec string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "spec.json")
+	if err := os.WriteFile(path, []byte(spec), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidatorRejectsInvalidPattern(t *testing.T) {
+	path := writeSpec(t, `{"components": {"schemas": {"id": {"type": "string", "pattern": "(?=x)"}}}}`)
+	if _, err := NewRequestValidator(path, ValidationEnforce); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Fatalf("expected invalid pattern error, got %v", err)
+	}
+}
+
+func TestValidatorEscapedPath(t *testing.T) {
+	path := writeSpec(t, `{"paths": {"/files/{name}": {"get": {"parameters": [
+		{"name": "name", "in": "path", "required": true, "schema": {"type": "string", "pattern": "^[a-z%/]+$"}}]}}}}`)
+	v, err := NewRequestValidator(path, ValidationEnforce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, valid := range map[string]bool{
+		"/files/100%25": false,
+		"/files/a%25b":  true,
+		"/files/a%2Fb":  true,
+		"/files/ABC":    false,
+	} {
+		violations := v.Validate(httptest.NewRequest("GET", target, nil))
+		if (len(violations) == 0) != valid {
+			t.Errorf("%s: valid %v, got violations %v", target, valid, violations)
+		}
+	}
+}
+
+func TestValidatorBodyLimit(t *testing.T) {
+	path := writeSpec(t, `{"paths": {"/orders": {"post": {"requestBody": {"required": true, "content": {"application/json":
+		{"schema": {"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}}}}}}}}}}`)
+	v, err := NewRequestValidator(path, ValidationEnforce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.MaxBody = 32
+	large := `{"id": 1, "note": "` + strings.Repeat("x", 64) + `"}`
+	for body, valid := range map[string]bool{`{"id": 1}`: true, `{"id": "x"}`: false, large: true} {
+		r := httptest.NewRequest("POST", "/orders", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if violations := v.Validate(r); (len(violations) == 0) != valid {
+			t.Errorf("%.20s: valid %v, got violations %v", body, valid, violations)
+		}
+		// the body stays readable for the proxy
+		if data, _ := io.ReadAll(r.Body); string(data) != body {
+			t.Errorf("expected the body to be passed on, got %q", data)
+		}
+	}
+}